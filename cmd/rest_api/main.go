@@ -1,24 +1,33 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/joho/godotenv"
 	"github.com/liamrlawrence/sigil-rest_api/internal/database"
+	"github.com/liamrlawrence/sigil-rest_api/internal/llm"
+	"github.com/liamrlawrence/sigil-rest_api/internal/mailer"
+	"github.com/liamrlawrence/sigil-rest_api/internal/models"
+	"github.com/liamrlawrence/sigil-rest_api/internal/oidc"
 	"github.com/liamrlawrence/sigil-rest_api/internal/routes"
 	"github.com/liamrlawrence/sigil-rest_api/internal/server"
+	"github.com/liamrlawrence/sigil-rest_api/internal/sessioncache"
 	"net/http"
+	"os"
 	"path/filepath"
 )
 
 func initialize(s *server.Server) error {
 	// load environment variables
-	var envFiles = [...]string{"database.env", "jenkins.env", "openai.env"}
+	var envFiles = [...]string{"auth.env", "database.env", "jenkins.env", "mail.env", "oidc.env", "openai.env"}
 
 	var err error
 	for _, ef := range envFiles {
+		// settings can also come from the environment itself, so a file that doesn't exist is skipped
 		err = godotenv.Load(filepath.Join("envs", ef))
-		if err != nil {
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
 			return fmt.Errorf("initialize: %w", err)
 		}
 	}
@@ -29,10 +38,27 @@ func initialize(s *server.Server) error {
 		return fmt.Errorf("initialize: %w", err)
 	}
 
-	// setup middleware to check for session tokens
-	s.Router.Use(routes.AuthTokenMiddleware(s))
+	// cache validated sessions, dropping them whenever any replica revokes one
+	s.SessionCache = sessioncache.NewFromEnv()
+	go s.SessionCache.Listen(context.Background(), s.DBPool)
 
-	// setup endpoints for routes
+	// setup outgoing email
+	s.Mailer = mailer.NewMailerFromEnv()
+
+	// setup single sign-on, if an identity provider is configured
+	if cfg := oidc.ConfigFromEnv(); cfg != nil {
+		s.OIDC = oidc.NewProvider(*cfg)
+	}
+
+	// load the chat model aliases and the providers that run them
+	s.Providers = llm.NewProvidersFromEnv()
+	s.Models = models.NewRegistryFromEnv(s.DBPool)
+	err = s.Models.Load(context.Background())
+	if err != nil {
+		return fmt.Errorf("initialize: %w", err)
+	}
+
+	// setup endpoints for routes, each route group declares how it authenticates
 	routes.SetupEndpoints(s)
 	return nil
 }
@@ -0,0 +1,76 @@
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"log"
+)
+
+type EventType string
+
+const (
+	EventLoginSuccess   EventType = "login_success"
+	EventLoginFailure   EventType = "login_failure"
+	EventRefresh        EventType = "refresh"
+	EventRefreshReuse   EventType = "refresh_reuse"
+	EventLogout         EventType = "logout"
+	EventSessionRevoked EventType = "session_revoked"
+	EventLockout        EventType = "lockout"
+	EventUnlock         EventType = "unlock"
+	EventPasswordChange EventType = "password_change"
+	EventPasswordReset  EventType = "password_reset_request"
+	EventAPIKeyCreated  EventType = "api_key_created"
+	EventAPIKeyRevoked  EventType = "api_key_revoked"
+	EventTOTPEnabled    EventType = "totp_enabled"
+	EventUserCreated    EventType = "user_created"
+	EventUserDisabled   EventType = "user_disabled"
+	EventUserEnabled    EventType = "user_enabled"
+	EventRoleChanged    EventType = "role_changed"
+	EventImpersonation  EventType = "impersonation"
+)
+
+var EventTypes = []EventType{
+	EventLoginSuccess, EventLoginFailure, EventRefresh, EventRefreshReuse, EventLogout, EventSessionRevoked,
+	EventLockout, EventUnlock, EventPasswordChange, EventPasswordReset, EventAPIKeyCreated, EventAPIKeyRevoked,
+	EventTOTPEnabled, EventUserCreated, EventUserDisabled, EventUserEnabled, EventRoleChanged,
+	EventImpersonation,
+}
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Event is one row of Auth.Audit_Events. The session ID is only ever stored as a hash.
+type Event struct {
+	Type      EventType
+	Username  string
+	IP        string
+	UserAgent string
+	SessionID string
+	Outcome   string
+	Detail    string
+
+	// ImpersonatedBy is the admin who caused the event while impersonating Username
+	ImpersonatedBy string
+}
+
+func HashSessionID(sessionID string) string {
+	if sessionID == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:])
+}
+
+// Record writes the event to the audit table. Failures are logged rather than returned so that
+// auditing never turns a successful request into a failed one.
+func Record(ctx context.Context, pool *pgxpool.Pool, e Event) {
+	_, err := pool.Exec(ctx, "CALL Auth.SP_Insert_Audit_Event($1, NULLIF($2, ''), NULLIF($3, '')::INET, NULLIF($4, ''), NULLIF($5, ''), $6, NULLIF($7, ''), NULLIF($8, ''));",
+		string(e.Type), e.Username, e.IP, e.UserAgent, HashSessionID(e.SessionID), e.Outcome, e.Detail, e.ImpersonatedBy)
+	if err != nil {
+		log.Printf("audit: failed to record %s for %s: %v", e.Type, e.Username, err)
+	}
+}
@@ -0,0 +1,179 @@
+package dberr
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"net/http"
+	"sort"
+)
+
+// Error is a failure raised by a stored function, with a stable HTTP status and JSON error code.
+// The Auth functions raise these with a dedicated SQLSTATE in the GA class, or with the
+// error code as the HINT, so the wording of their messages can change freely. Functions that
+// still raise a plain P0001 are matched on their message.
+type Error struct {
+	Code    string
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) WriteJSON(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(e.Status)
+	fmt.Fprintf(w, `{
+	"status": "failed",
+	"error": "%s",
+	"message": "%s"
+}`, e.Code, e.Message)
+}
+
+var (
+	ErrUnknown  = &Error{"unknown", http.StatusInternalServerError, "Unknown error"}
+	ErrNotFound = &Error{"not_found", http.StatusNotFound, "not found"}
+
+	// ErrMalformedID is a token or path ID that isn't a UUID, which callers map to the error for the thing it names
+	ErrMalformedID = &Error{"malformed_id", http.StatusBadRequest, "malformed id"}
+
+	ErrInvalidSession      = &Error{"invalid_session", http.StatusUnauthorized, "invalid session id"}
+	ErrSessionExpired      = &Error{"session_expired", http.StatusUnauthorized, "session id is expired"}
+	ErrSessionRevoked      = &Error{"session_revoked", http.StatusUnauthorized, "session revoked"}
+	ErrInvalidRefreshToken = &Error{"invalid_refresh_token", http.StatusUnauthorized, "invalid refresh token"}
+	ErrRefreshTokenExpired = &Error{"refresh_token_expired", http.StatusUnauthorized, "refresh token is expired"}
+	ErrRefreshTokenReused  = &Error{"refresh_token_reused", http.StatusUnauthorized, "refresh token was already used, sign in again"}
+	ErrIncorrectLogin      = &Error{"incorrect_credentials", http.StatusUnauthorized, "incorrect username or password"}
+	ErrUsernameTaken       = &Error{"username_taken", http.StatusConflict, "username already exists"}
+	ErrEmailTaken          = &Error{"email_taken", http.StatusConflict, "email already exists"}
+	ErrUserNotFound        = &Error{"user_not_found", http.StatusNotFound, "user not found"}
+	ErrSessionNotFound     = &Error{"session_not_found", http.StatusNotFound, "session not found"}
+	ErrInvalidResetToken   = &Error{"invalid_reset_token", http.StatusBadRequest, "invalid or expired reset token"}
+	ErrResetTokenExpired   = &Error{"reset_token_expired", http.StatusBadRequest, "invalid or expired reset token"}
+	ErrInvalidAPIKey       = &Error{"invalid_api_key", http.StatusUnauthorized, "invalid api key"}
+	ErrAPIKeyExpired       = &Error{"api_key_expired", http.StatusUnauthorized, "api key is expired"}
+	ErrAPIKeyRevoked       = &Error{"api_key_revoked", http.StatusUnauthorized, "api key revoked"}
+	ErrAPIKeyNameTaken     = &Error{"api_key_name_taken", http.StatusConflict, "api key name already exists"}
+	ErrAPIKeyNotFound      = &Error{"api_key_not_found", http.StatusNotFound, "api key not found"}
+	ErrTOTPAlreadyEnabled  = &Error{"totp_already_enabled", http.StatusConflict, "totp is already enabled"}
+	ErrNoPendingTOTP       = &Error{"no_pending_totp", http.StatusBadRequest, "no pending totp enrollment"}
+	ErrInvalidChallenge    = &Error{"invalid_totp_challenge", http.StatusUnauthorized, "invalid or expired totp challenge, sign in again"}
+	ErrChallengeExpired    = &Error{"totp_challenge_expired", http.StatusUnauthorized, "invalid or expired totp challenge, sign in again"}
+	ErrInvalidRecoveryCode = &Error{"invalid_recovery_code", http.StatusUnauthorized, "invalid recovery code"}
+	ErrInvalidOIDCState    = &Error{"invalid_oidc_state", http.StatusBadRequest, "invalid or expired sign in, start again"}
+	ErrOIDCNotLinked       = &Error{"oidc_not_linked", http.StatusForbidden, "no account is linked to this identity"}
+	ErrUserDisabled        = &Error{"user_disabled", http.StatusForbidden, "account is disabled"}
+	ErrIncorrectPassword   = &Error{"incorrect_password", http.StatusForbidden, "current password is incorrect"}
+	ErrCannotImpersonate   = &Error{"cannot_impersonate", http.StatusForbidden, "admins and disabled users can't be impersonated"}
+
+	ErrConversationNotFound = &Error{"conversation_not_found", http.StatusNotFound, "conversation not found"}
+	ErrPriceExists          = &Error{"price_exists", http.StatusConflict, "the model already has a price starting at that time"}
+	ErrBudgetNotFound       = &Error{"budget_not_found", http.StatusNotFound, "budget not found"}
+	ErrModelNotPriced       = &Error{"model_not_priced", http.StatusServiceUnavailable, "the model has no price, so it can't be checked against budgets"}
+)
+
+// byCode maps the SQLSTATE raised by the Auth functions to their typed errors
+var byCode = map[string]*Error{
+	"GA001": ErrInvalidSession,
+	"GA002": ErrSessionExpired,
+	"GA003": ErrSessionRevoked,
+	"GA004": ErrInvalidRefreshToken,
+	"GA005": ErrRefreshTokenExpired,
+	"GA006": ErrIncorrectLogin,
+	"GA007": ErrUsernameTaken,
+	"GA008": ErrEmailTaken,
+	"GA009": ErrUserNotFound,
+	"GA010": ErrSessionNotFound,
+	"GA011": ErrInvalidResetToken,
+	"GA012": ErrResetTokenExpired,
+	"GA013": ErrInvalidAPIKey,
+	"GA014": ErrAPIKeyExpired,
+	"GA015": ErrAPIKeyRevoked,
+	"GA016": ErrAPIKeyNameTaken,
+	"GA017": ErrAPIKeyNotFound,
+	"GA018": ErrTOTPAlreadyEnabled,
+	"GA019": ErrNoPendingTOTP,
+	"GA020": ErrInvalidChallenge,
+	"GA021": ErrChallengeExpired,
+	"GA022": ErrInvalidRecoveryCode,
+	"GA023": ErrInvalidOIDCState,
+	"GA024": ErrOIDCNotLinked,
+	"GA025": ErrRefreshTokenReused,
+	"GA026": ErrUserDisabled,
+	"GA027": ErrIncorrectPassword,
+	"GA028": ErrCannotImpersonate,
+	"GA029": ErrConversationNotFound,
+	"GA030": ErrPriceExists,
+	"GA031": ErrBudgetNotFound,
+	"GA032": ErrModelNotPriced,
+}
+
+var byHint = func() map[string]*Error {
+	m := make(map[string]*Error, len(byCode))
+	for _, e := range byCode {
+		m[e.Code] = e
+	}
+	return m
+}()
+
+// legacyMessages are the messages the functions raised with the generic P0001 before they had a SQLSTATE of
+// their own, so that a database that hasn't been migrated yet still maps to the typed errors
+var legacyMessages = map[string]*Error{
+	"invalid session id":              ErrInvalidSession,
+	"session id is expired":           ErrSessionExpired,
+	"invalid refresh token":           ErrInvalidRefreshToken,
+	"refresh token is expired":        ErrRefreshTokenExpired,
+	"incorrect username and password": ErrIncorrectLogin,
+	"incorrect username or password":  ErrIncorrectLogin,
+}
+
+var byMessage = func() map[string]*Error {
+	m := make(map[string]*Error, len(legacyMessages)+len(byCode))
+	for message, e := range legacyMessages {
+		m[message] = e
+	}
+	// Messages shared by two errors, like the reset token ones, go to the one with the lower SQLSTATE
+	codes := make([]string, 0, len(byCode))
+	for code := range byCode {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		if _, ok := m[byCode[code].Message]; !ok {
+			m[byCode[code].Message] = byCode[code]
+		}
+	}
+	return m
+}()
+
+// From maps an error returned by pgx to its typed error, or ErrUnknown if it isn't one the Auth functions raise
+func From(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// invalid_text_representation, raised when a parameter cast to UUID isn't one
+		if pgErr.Code == "22P02" {
+			return ErrMalformedID
+		}
+		if e, ok := byCode[pgErr.Code]; ok {
+			return e
+		}
+		if e, ok := byHint[pgErr.Hint]; ok {
+			return e
+		}
+		if e, ok := byMessage[pgErr.Message]; ok && pgErr.Code == "P0001" {
+			return e
+		}
+	}
+	return ErrUnknown
+}
@@ -0,0 +1,36 @@
+package dberr
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"testing"
+)
+
+func TestFrom(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want *Error
+	}{
+		{"sqlstate", &pgconn.PgError{Code: "GA006", Message: "anything"}, ErrIncorrectLogin},
+		{"hint", &pgconn.PgError{Code: "P0001", Hint: "user_not_found"}, ErrUserNotFound},
+		{"legacy message", &pgconn.PgError{Code: "P0001", Message: "incorrect username and password"}, ErrIncorrectLogin},
+		{"legacy expired session", &pgconn.PgError{Code: "P0001", Message: "session id is expired"}, ErrSessionExpired},
+		{"current message", &pgconn.PgError{Code: "P0001", Message: "api key revoked"}, ErrAPIKeyRevoked},
+		{"message with another sqlstate", &pgconn.PgError{Code: "23505", Message: "invalid session id"}, ErrUnknown},
+		{"malformed uuid", &pgconn.PgError{Code: "22P02", Message: `invalid input syntax for type uuid: "garbage"`}, ErrMalformedID},
+		{"no rows", fmt.Errorf("query: %w", pgx.ErrNoRows), ErrNotFound},
+		{"typed", fmt.Errorf("wrapped: %w", ErrEmailTaken), ErrEmailTaken},
+		{"other", errors.New("connection refused"), ErrUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := From(tt.err); got != tt.want {
+				t.Errorf("From(%v) = %v, want %v", tt.err, got.Code, tt.want.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/liamrlawrence/sigil-rest_api/internal/openai"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	anthropicVersion = "2023-06-01"
+
+	// anthropicMaxTokens is used when the request leaves the length of the reply open, which the Messages API doesn't allow
+	anthropicMaxTokens = 4096
+)
+
+// Anthropic runs models through the Messages API of Anthropic
+type Anthropic struct {
+	BaseURL      string
+	APIKey       string
+	Client       *http.Client
+	StreamClient *http.Client
+}
+
+func NewAnthropic(apiKey string) *Anthropic {
+	return &Anthropic{
+		BaseURL:      "https://api.anthropic.com/v1",
+		APIKey:       apiKey,
+		Client:       &http.Client{Timeout: 300 * time.Second},
+		StreamClient: &http.Client{},
+	}
+}
+
+type anthropicRequest struct {
+	Model       string    `json:"model"`
+	System      string    `json:"system,omitempty"`
+	Messages    []Message `json:"messages"`
+	Temperature float64   `json:"temperature"`
+	MaxTokens   int       `json:"max_tokens"`
+	Stream      bool      `json:"stream,omitempty"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// newAnthropicRequest moves system messages into the system prompt, where the Messages API expects them,
+// and drops any turns before the first user turn
+func newAnthropicRequest(req Request, stream bool) anthropicRequest {
+	body := anthropicRequest{
+		Model:       req.Model,
+		Temperature: req.Temperature,
+		MaxTokens:   req.MaxTokens,
+		Stream:      stream,
+	}
+	// The Messages API only goes up to a temperature of 1
+	if body.Temperature > 1 {
+		body.Temperature = 1
+	}
+	if body.MaxTokens == 0 {
+		body.MaxTokens = anthropicMaxTokens
+	}
+
+	var system []string
+	for _, m := range req.Messages {
+		if m.Role == "system" {
+			system = append(system, m.Content)
+			continue
+		}
+		body.Messages = append(body.Messages, m)
+	}
+	body.System = strings.Join(system, "\n\n")
+
+	// The Messages API refuses a conversation that doesn't start with a user turn, which a trimmed history can
+	for len(body.Messages) > 1 && body.Messages[0].Role != "user" {
+		body.Messages = body.Messages[1:]
+	}
+	return body
+}
+
+func (p *Anthropic) send(ctx context.Context, client *http.Client, body anthropicRequest) (*http.Response, error) {
+	data, _ := json.Marshal(body)
+	req, err := http.NewRequestWithContext(ctx, "POST", p.BaseURL+"/messages", bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Api-Key", p.APIKey)
+	req.Header.Set("Anthropic-Version", anthropicVersion)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		errBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		err = fmt.Errorf("%s returned %s: %s", p.BaseURL, resp.Status, errBody)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			err = &Error{Kind: ErrRateLimited, RetryAfter: openai.ParseRetryAfter(resp.Header.Get("Retry-After")), Err: err}
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (p *Anthropic) Chat(ctx context.Context, req Request) (Response, error) {
+	resp, err := p.send(ctx, p.Client, newAnthropicRequest(req, false))
+	if err != nil {
+		return Response{}, fmt.Errorf("anthropic chat: %w", classify(err))
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+		Usage anthropicUsage `json:"usage"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return Response{}, fmt.Errorf("anthropic chat: %w", err)
+	}
+
+	var reply strings.Builder
+	for _, c := range body.Content {
+		if c.Type == "text" {
+			reply.WriteString(c.Text)
+		}
+	}
+	return Response{
+		Content: reply.String(),
+		Usage:   Usage{PromptTokens: body.Usage.InputTokens, CompletionTokens: body.Usage.OutputTokens},
+	}, nil
+}
+
+func (p *Anthropic) ChatStream(ctx context.Context, req Request, onDelta func(string) error) (Response, error) {
+	resp, err := p.send(ctx, p.StreamClient, newAnthropicRequest(req, true))
+	if err != nil {
+		return Response{}, fmt.Errorf("anthropic chat stream: %w", &notAcceptedError{classify(err)})
+	}
+	defer resp.Body.Close()
+
+	var reply strings.Builder
+	var usage Usage
+	var gotUsage bool
+	done := errors.New("done")
+	err = scanEvents(resp.Body, func(event string, data string) error {
+		var e struct {
+			Message struct {
+				Usage anthropicUsage `json:"usage"`
+			} `json:"message"`
+			Delta struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"delta"`
+			Usage anthropicUsage `json:"usage"`
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return err
+		}
+
+		switch event {
+		case "message_start":
+			usage.PromptTokens = e.Message.Usage.InputTokens
+		case "content_block_delta":
+			if e.Delta.Type != "text_delta" || e.Delta.Text == "" {
+				return nil
+			}
+			reply.WriteString(e.Delta.Text)
+			return onDelta(e.Delta.Text)
+		case "message_delta":
+			usage.CompletionTokens = e.Usage.OutputTokens
+			gotUsage = true
+		case "message_stop":
+			return done
+		case "error":
+			return errors.New(e.Error.Message)
+		}
+		return nil
+	})
+	if err == done {
+		err = nil
+	} else if err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+
+	res := Response{Content: reply.String(), Usage: usage}
+	if !gotUsage {
+		res.Usage = EstimateUsage(req.Messages, reply.String())
+	}
+	if err != nil {
+		return res, fmt.Errorf("anthropic chat stream: %w", classify(err))
+	}
+	return res, nil
+}
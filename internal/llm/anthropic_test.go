@@ -0,0 +1,172 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestAnthropic points a provider at handler, which is also handed the decoded request body
+func newTestAnthropic(t *testing.T, handler func(w http.ResponseWriter, body anthropicRequest)) *Anthropic {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/messages" || r.Header.Get("X-Api-Key") != "sk-test" || r.Header.Get("Anthropic-Version") != anthropicVersion {
+			t.Errorf("request = %s %v, want /messages with the API key and version", r.URL.Path, r.Header)
+		}
+		var body anthropicRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		handler(w, body)
+	}))
+	t.Cleanup(srv.Close)
+
+	p := NewAnthropic("sk-test")
+	p.BaseURL = srv.URL
+	return p
+}
+
+func TestNewAnthropicRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		req  Request
+		want anthropicRequest
+	}{
+		{
+			"system messages become the system prompt",
+			Request{Model: "claude", Temperature: 0.5, MaxTokens: 100, Messages: []Message{
+				{Role: "system", Content: "be brief"},
+				{Role: "user", Content: "hi"},
+				{Role: "system", Content: "be kind"},
+			}},
+			anthropicRequest{Model: "claude", System: "be brief\n\nbe kind", Temperature: 0.5, MaxTokens: 100, Messages: []Message{
+				{Role: "user", Content: "hi"},
+			}},
+		},
+		{
+			"temperature is capped and max tokens defaulted",
+			Request{Model: "claude", Temperature: 1.5, Messages: []Message{{Role: "user", Content: "hi"}}},
+			anthropicRequest{Model: "claude", Temperature: 1, MaxTokens: anthropicMaxTokens, Messages: []Message{{Role: "user", Content: "hi"}}},
+		},
+		{
+			"trimmed history starting with a reply",
+			Request{Model: "claude", MaxTokens: 10, Messages: []Message{
+				{Role: "system", Content: "be brief"},
+				{Role: "assistant", Content: "old reply"},
+				{Role: "user", Content: "hi"},
+			}},
+			anthropicRequest{Model: "claude", System: "be brief", MaxTokens: 10, Messages: []Message{
+				{Role: "user", Content: "hi"},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newAnthropicRequest(tt.req, false); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("newAnthropicRequest = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+var anthropicTestRequest = Request{Model: "claude", Messages: []Message{{Role: "user", Content: "hello"}}}
+
+func TestAnthropicChat(t *testing.T) {
+	p := newTestAnthropic(t, func(w http.ResponseWriter, body anthropicRequest) {
+		if body.Stream {
+			t.Error("stream = true, want false")
+		}
+		fmt.Fprint(w, `{"content": [{"type": "text", "text": "hi "}, {"type": "tool_use"}, {"type": "text", "text": "there"}], "usage": {"input_tokens": 3, "output_tokens": 2}}`)
+	})
+
+	res, err := p.Chat(context.Background(), anthropicTestRequest)
+	if err != nil {
+		t.Fatalf("Chat: %v", err)
+	}
+	want := Response{Content: "hi there", Usage: Usage{PromptTokens: 3, CompletionTokens: 2}}
+	if res != want {
+		t.Errorf("res = %+v, want %+v", res, want)
+	}
+}
+
+func TestAnthropicChatStream(t *testing.T) {
+	p := newTestAnthropic(t, func(w http.ResponseWriter, body anthropicRequest) {
+		if !body.Stream {
+			t.Error("stream = false, want true")
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: message_start\ndata: {\"message\": {\"usage\": {\"input_tokens\": 5}}}\n\n")
+		fmt.Fprint(w, "event: ping\ndata: {}\n\n")
+		fmt.Fprint(w, "event: content_block_delta\ndata: {\"delta\": {\"type\": \"text_delta\", \"text\": \"Hel\"}}\n\n")
+		fmt.Fprint(w, "event: content_block_delta\ndata: {\"delta\": {\"type\": \"text_delta\", \"text\": \"lo\"}}\n\n")
+		fmt.Fprint(w, "event: message_delta\ndata: {\"usage\": {\"output_tokens\": 2}}\n\n")
+		fmt.Fprint(w, "event: message_stop\ndata: {}\n\n")
+	})
+
+	var deltas []string
+	res, err := p.ChatStream(context.Background(), anthropicTestRequest, func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ChatStream: %v", err)
+	}
+	want := Response{Content: "Hello", Usage: Usage{PromptTokens: 5, CompletionTokens: 2}}
+	if res != want || !reflect.DeepEqual(deltas, []string{"Hel", "lo"}) {
+		t.Errorf("res = %+v with deltas %q, want %+v", res, deltas, want)
+	}
+}
+
+func TestAnthropicChatStreamCutOff(t *testing.T) {
+	p := newTestAnthropic(t, func(w http.ResponseWriter, body anthropicRequest) {
+		fmt.Fprint(w, "event: message_start\ndata: {\"message\": {\"usage\": {\"input_tokens\": 5}}}\n\n")
+		fmt.Fprint(w, "event: content_block_delta\ndata: {\"delta\": {\"type\": \"text_delta\", \"text\": \"Hel\"}}\n\n")
+	})
+
+	res, err := p.ChatStream(context.Background(), anthropicTestRequest, func(delta string) error { return nil })
+	if !errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ErrNotAccepted) {
+		t.Errorf("err = %v, want io.ErrUnexpectedEOF from an accepted stream", err)
+	}
+	if res.Content != "Hel" || res.Usage != EstimateUsage(anthropicTestRequest.Messages, "Hel") {
+		t.Errorf("res = %+v, want what arrived with the usage estimated", res)
+	}
+}
+
+func TestAnthropicStreamError(t *testing.T) {
+	p := newTestAnthropic(t, func(w http.ResponseWriter, body anthropicRequest) {
+		fmt.Fprint(w, "event: error\ndata: {\"error\": {\"type\": \"overloaded_error\", \"message\": \"Overloaded\"}}\n\n")
+	})
+
+	_, err := p.ChatStream(context.Background(), anthropicTestRequest, func(delta string) error { return nil })
+	if err == nil || errors.Is(err, ErrNotAccepted) {
+		t.Errorf("err = %v, want the error event of an accepted stream", err)
+	}
+}
+
+func TestAnthropicRateLimited(t *testing.T) {
+	p := newTestAnthropic(t, func(w http.ResponseWriter, body anthropicRequest) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"type": "error", "error": {"type": "rate_limit_error", "message": "slow down"}}`)
+	})
+
+	_, err := p.ChatStream(context.Background(), anthropicTestRequest, func(delta string) error { return nil })
+	var llmErr *Error
+	if !errors.Is(err, ErrRateLimited) || !errors.Is(err, ErrNotAccepted) || !errors.As(err, &llmErr) || llmErr.RetryAfter != 7*time.Second {
+		t.Errorf("err = %v, want a rate limit of 7s that wasn't accepted", err)
+	}
+
+	_, err = p.Chat(context.Background(), anthropicTestRequest)
+	if !errors.Is(err, ErrRateLimited) {
+		t.Errorf("err = %v, want ErrRateLimited", err)
+	}
+}
@@ -0,0 +1,46 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Fake answers without calling anything, echoing the last message back so that replies and usage are
+// the same every time for the same request
+type Fake struct{}
+
+func (Fake) reply(req Request) string {
+	last := ""
+	if len(req.Messages) > 0 {
+		last = req.Messages[len(req.Messages)-1].Content
+	}
+	return fmt.Sprintf("fake reply from %s to %d messages: %s", req.Model, len(req.Messages), last)
+}
+
+func (f Fake) Chat(ctx context.Context, req Request) (Response, error) {
+	if err := ctx.Err(); err != nil {
+		return Response{}, err
+	}
+
+	reply := f.reply(req)
+	return Response{Content: reply, Usage: EstimateUsage(req.Messages, reply)}, nil
+}
+
+// ChatStream sends the reply one word at a time
+func (f Fake) ChatStream(ctx context.Context, req Request, onDelta func(string) error) (Response, error) {
+	reply := f.reply(req)
+
+	var sent strings.Builder
+	for _, word := range strings.SplitAfter(reply, " ") {
+		err := ctx.Err()
+		if err == nil {
+			err = onDelta(word)
+		}
+		if err != nil {
+			return Response{Content: sent.String(), Usage: EstimateUsage(req.Messages, sent.String())}, fmt.Errorf("fake chat stream: %w", err)
+		}
+		sent.WriteString(word)
+	}
+	return Response{Content: reply, Usage: EstimateUsage(req.Messages, reply)}, nil
+}
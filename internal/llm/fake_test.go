@@ -0,0 +1,73 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var fakeTestRequest = Request{Model: "fake", Messages: []Message{{Role: "system", Content: "be brief"}, {Role: "user", Content: "hello there"}}}
+
+func TestFakeChat(t *testing.T) {
+	res, err := Fake{}.Chat(context.Background(), fakeTestRequest)
+	if err != nil {
+		t.Fatalf("Chat: %v", err)
+	}
+	want := "fake reply from fake to 2 messages: hello there"
+	if res.Content != want || res.Usage != EstimateUsage(fakeTestRequest.Messages, want) {
+		t.Errorf("res = %+v, want %q with its estimated usage", res, want)
+	}
+
+	again, _ := Fake{}.Chat(context.Background(), fakeTestRequest)
+	if again != res {
+		t.Errorf("second reply = %+v, want the same as the first", again)
+	}
+}
+
+func TestFakeChatStream(t *testing.T) {
+	chat, _ := Fake{}.Chat(context.Background(), fakeTestRequest)
+
+	var deltas []string
+	res, err := Fake{}.ChatStream(context.Background(), fakeTestRequest, func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ChatStream: %v", err)
+	}
+	if res != chat || strings.Join(deltas, "") != chat.Content || len(deltas) < 2 {
+		t.Errorf("res = %+v with deltas %q, want the reply of Chat a word at a time", res, deltas)
+	}
+}
+
+func TestFakeChatStreamStops(t *testing.T) {
+	gone := errors.New("caller went away")
+	var deltas []string
+	res, err := Fake{}.ChatStream(context.Background(), fakeTestRequest, func(delta string) error {
+		if len(deltas) == 2 {
+			return gone
+		}
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if !errors.Is(err, gone) {
+		t.Errorf("err = %v, want the error from onDelta", err)
+	}
+	if sent := strings.Join(deltas, ""); res.Content != sent || res.Usage != EstimateUsage(fakeTestRequest.Messages, sent) {
+		t.Errorf("res = %+v, want only what was sent, %q", res, sent)
+	}
+}
+
+func TestFakeCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := (Fake{}).Chat(ctx, fakeTestRequest); !errors.Is(err, context.Canceled) {
+		t.Errorf("Chat err = %v, want context.Canceled", err)
+	}
+	res, err := Fake{}.ChatStream(ctx, fakeTestRequest, func(delta string) error { return nil })
+	if !errors.Is(err, context.Canceled) || res.Content != "" {
+		t.Errorf("ChatStream = %+v, %v, want nothing sent and context.Canceled", res, err)
+	}
+}
@@ -0,0 +1,160 @@
+package llm
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/liamrlawrence/sigil-rest_api/internal/openai"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+// Request is a chat completion for the model with the given upstream ID. MaxTokens of 0 leaves the
+// length of the reply to the provider.
+type Request struct {
+	Model       string
+	Messages    []Message
+	Temperature float64
+	MaxTokens   int
+}
+
+type Response struct {
+	Content string
+	Usage   Usage
+}
+
+var (
+	// ErrRateLimited matches the error of a provider that is still rate limiting after any retries
+	ErrRateLimited = errors.New("llm: rate limited")
+
+	// ErrTimeout matches the error of a provider that didn't reply in time
+	ErrTimeout = errors.New("llm: timed out")
+
+	// ErrNotAccepted matches the error of a stream the provider refused, or failed before it answered,
+	// so nothing was generated or charged for
+	ErrNotAccepted = errors.New("llm: not accepted")
+)
+
+type notAcceptedError struct {
+	err error
+}
+
+func (e *notAcceptedError) Error() string        { return e.err.Error() }
+func (e *notAcceptedError) Unwrap() error        { return e.err }
+func (e *notAcceptedError) Is(target error) bool { return target == ErrNotAccepted }
+
+// Error is a failed call that handlers can pass on to the caller, whichever provider it came from. Kind is
+// ErrRateLimited or ErrTimeout, and RetryAfter is how long a rate limited provider asked to be left alone
+// for, 0 when it didn't say.
+type Error struct {
+	Kind       error
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *Error) Error() string        { return e.Err.Error() }
+func (e *Error) Unwrap() error        { return e.Err }
+func (e *Error) Is(target error) bool { return target == e.Kind }
+
+// classify wraps rate limits and timeouts from the clients of the providers in an Error, and marks a
+// stream the OpenAI client reports as not accepted
+func classify(err error) error {
+	classified := err
+	var apiErr *openai.APIError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, openai.ErrRateLimited) && errors.As(err, &apiErr):
+		classified = &Error{Kind: ErrRateLimited, RetryAfter: apiErr.RetryAfter, Err: err}
+	case errors.Is(err, openai.ErrTimeout), errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		classified = &Error{Kind: ErrTimeout, Err: err}
+	}
+
+	if errors.Is(err, openai.ErrNotAccepted) {
+		return &notAcceptedError{classified}
+	}
+	return classified
+}
+
+// Provider is a vendor or server that runs chat models
+type Provider interface {
+	Chat(ctx context.Context, req Request) (Response, error)
+
+	// ChatStream calls onDelta with each piece of the reply as it arrives, and stops when onDelta returns an
+	// error. When the stream is cut off it returns what was received along with the error, with the usage
+	// estimated if the provider never reported it. The error matches ErrNotAccepted when the provider never
+	// answered the request.
+	ChatStream(ctx context.Context, req Request, onDelta func(string) error) (Response, error)
+}
+
+// Providers are the configured providers by the name models refer to them with
+type Providers map[string]Provider
+
+func (p Providers) Get(name string) (Provider, bool) {
+	provider, ok := p[name]
+	return provider, ok
+}
+
+// NewProvidersFromEnv configures every provider that has its settings in the environment. The fake
+// provider is always there, so models can be pointed at it for testing without an upstream.
+func NewProvidersFromEnv() Providers {
+	providers := Providers{"fake": Fake{}}
+	if key := os.Getenv("OPENAI_API_KEY"); key != "" {
+		providers["openai"] = NewOpenAI(key, os.Getenv("OPENAI_API_ORG"))
+	}
+	if key := os.Getenv("ANTHROPIC_API_KEY"); key != "" {
+		providers["anthropic"] = NewAnthropic(key)
+	}
+	if baseURL := os.Getenv("LOCAL_LLM_BASE_URL"); baseURL != "" {
+		providers["local"] = NewOpenAICompatible(baseURL, os.Getenv("LOCAL_LLM_API_KEY"))
+	}
+	return providers
+}
+
+// EstimateTokens is a rough upper bound on the tokens in text, for checks made before the model has counted them
+func EstimateTokens(text string) int {
+	return len(text)/3 + 1
+}
+
+// EstimateUsage stands in for the usage of a reply the provider never reported it for
+func EstimateUsage(messages []Message, reply string) Usage {
+	usage := Usage{CompletionTokens: EstimateTokens(reply)}
+	for _, m := range messages {
+		usage.PromptTokens += EstimateTokens(m.Content)
+	}
+	return usage
+}
+
+// scanEvents calls fn with the event name and data of each server-sent event in body until fn returns an error
+func scanEvents(body io.Reader, fn func(event string, data string) error) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var event string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			event = ""
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if err := fn(event, strings.TrimSpace(strings.TrimPrefix(line, "data:"))); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,54 @@
+package llm
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestScanEvents(t *testing.T) {
+	type event struct{ name, data string }
+
+	tests := []struct {
+		name string
+		body string
+		want []event
+	}{
+		{"named events", "event: a\ndata: 1\n\nevent: b\ndata: 2\n\n", []event{{"a", "1"}, {"b", "2"}}},
+		{"unnamed events", "data: 1\n\ndata: 2\n\n", []event{{"", "1"}, {"", "2"}}},
+		{"name resets after a blank line", "event: a\ndata: 1\n\ndata: 2\n\n", []event{{"a", "1"}, {"", "2"}}},
+		{"no space after the colon", "event:a\ndata:1\n\n", []event{{"a", "1"}}},
+		{"comments and other fields", ": keep-alive\nid: 7\nretry: 100\nevent: a\ndata: 1\n\n", []event{{"a", "1"}}},
+		{"last event without a blank line", "event: a\ndata: 1", []event{{"a", "1"}}},
+		{"carriage returns", "event: a\r\ndata: 1\r\n\r\n", []event{{"a", "1"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []event
+			err := scanEvents(strings.NewReader(tt.body), func(name string, data string) error {
+				got = append(got, event{name, data})
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("scanEvents: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScanEventsStops(t *testing.T) {
+	stop := errors.New("stop")
+	calls := 0
+	err := scanEvents(strings.NewReader("data: 1\n\ndata: 2\n\n"), func(name string, data string) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("err = %v after %d calls, want stop after 1", err, calls)
+	}
+}
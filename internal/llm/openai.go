@@ -0,0 +1,82 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"github.com/liamrlawrence/sigil-rest_api/internal/openai"
+	"strings"
+)
+
+// OpenAI runs models through the chat completions API of OpenAI, or of a local server that implements it
+// such as Ollama or llama.cpp
+type OpenAI struct {
+	Client *openai.Client
+}
+
+func NewOpenAI(apiKey string, organization string) *OpenAI {
+	return &OpenAI{Client: openai.New(apiKey, organization)}
+}
+
+// NewOpenAICompatible is for a local server, which usually doesn't need an API key
+func NewOpenAICompatible(baseURL string, apiKey string) *OpenAI {
+	return &OpenAI{Client: openai.NewCompatible(baseURL, apiKey)}
+}
+
+func newOpenAIRequest(req Request) openai.ChatCompletionRequest {
+	messages := make([]openai.Message, len(req.Messages))
+	for i, m := range req.Messages {
+		messages[i] = openai.Message{Role: m.Role, Content: m.Content}
+	}
+
+	return openai.ChatCompletionRequest{
+		Model:       req.Model,
+		Messages:    messages,
+		Temperature: req.Temperature,
+		MaxTokens:   req.MaxTokens,
+	}
+}
+
+func (p *OpenAI) Chat(ctx context.Context, req Request) (Response, error) {
+	resp, err := p.Client.CreateChatCompletion(ctx, newOpenAIRequest(req))
+	if err != nil {
+		return Response{}, fmt.Errorf("openai chat: %w", classify(err))
+	}
+
+	return Response{
+		Content: resp.Choices[0].Message.Content,
+		Usage:   Usage{PromptTokens: resp.Usage.PromptTokens, CompletionTokens: resp.Usage.CompletionTokens},
+	}, nil
+}
+
+func (p *OpenAI) ChatStream(ctx context.Context, req Request, onDelta func(string) error) (Response, error) {
+	body := newOpenAIRequest(req)
+	body.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+
+	var reply strings.Builder
+	var usage *openai.Usage
+	err := p.Client.CreateChatCompletionStream(ctx, body, func(chunk openai.ChatCompletionChunk) error {
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content == "" {
+				continue
+			}
+			reply.WriteString(choice.Delta.Content)
+			if err := onDelta(choice.Delta.Content); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	// Local servers don't always report usage when streaming
+	res := Response{Content: reply.String(), Usage: EstimateUsage(req.Messages, reply.String())}
+	if usage != nil {
+		res.Usage = Usage{PromptTokens: usage.PromptTokens, CompletionTokens: usage.CompletionTokens}
+	}
+	if err != nil {
+		return res, fmt.Errorf("openai chat stream: %w", classify(err))
+	}
+	return res, nil
+}
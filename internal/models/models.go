@@ -0,0 +1,159 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Model is what a chat model alias resolves to. Prices are in dollars per million tokens.
+type Model struct {
+	Alias        string   `json:"alias"`
+	Provider     string   `json:"provider"`
+	UpstreamID   string   `json:"upstream_id"`
+	Temperature  float64  `json:"temperature"`
+	MaxTokens    int      `json:"max_tokens"`
+	ContextLimit int      `json:"context_limit"`
+	AllowedRoles []string `json:"allowed_roles"`
+}
+
+// Allows reports whether callers with the role may use the model, every role may when AllowedRoles is empty
+func (m Model) Allows(role string) bool {
+	if len(m.AllowedRoles) == 0 {
+		return true
+	}
+	for _, r := range m.AllowedRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (m Model) validate() error {
+	switch {
+	case m.Alias == "":
+		return errors.New("model without an alias")
+	case m.UpstreamID == "":
+		return fmt.Errorf("model %q: missing upstream_id", m.Alias)
+	case m.ContextLimit <= 0:
+		return fmt.Errorf("model %q: context_limit must be positive", m.Alias)
+	case m.MaxTokens < 0 || m.MaxTokens > m.ContextLimit:
+		return fmt.Errorf("model %q: max_tokens must be between 0 and context_limit", m.Alias)
+	case m.Temperature < 0 || m.Temperature > 2:
+		return fmt.Errorf("model %q: temperature must be between 0 and 2", m.Alias)
+	}
+	return nil
+}
+
+// Registry resolves model aliases. It is loaded from the JSON file at AI_MODELS_FILE when that is set,
+// otherwise from the AI.Models table, and can be reloaded without restarting the server.
+type Registry struct {
+	pool *pgxpool.Pool
+	file string
+
+	mu     sync.RWMutex
+	models map[string]Model
+}
+
+func NewRegistry(pool *pgxpool.Pool, file string) *Registry {
+	return &Registry{pool: pool, file: file}
+}
+
+func NewRegistryFromEnv(pool *pgxpool.Pool) *Registry {
+	return NewRegistry(pool, os.Getenv("AI_MODELS_FILE"))
+}
+
+// Load replaces the models with the current ones from the file or Postgres, keeping the old ones if that fails
+func (r *Registry) Load(ctx context.Context) error {
+	var list []Model
+	var err error
+	if r.file != "" {
+		list, err = loadFile(r.file)
+	} else {
+		list, err = loadDB(ctx, r.pool)
+	}
+	if err != nil {
+		return fmt.Errorf("load models: %w", err)
+	}
+
+	models := make(map[string]Model, len(list))
+	for _, m := range list {
+		if m.Provider == "" {
+			m.Provider = "openai"
+		}
+		if err := m.validate(); err != nil {
+			return fmt.Errorf("load models: %w", err)
+		}
+		if _, ok := models[m.Alias]; ok {
+			return fmt.Errorf("load models: duplicate alias %q", m.Alias)
+		}
+		models[m.Alias] = m
+	}
+
+	r.mu.Lock()
+	r.models = models
+	r.mu.Unlock()
+	return nil
+}
+
+func loadFile(path string) ([]Model, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Model
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return list, nil
+}
+
+func loadDB(ctx context.Context, pool *pgxpool.Pool) ([]Model, error) {
+	rows, err := pool.Query(ctx, `SELECT alias, provider, upstream_id, temperature, COALESCE(max_tokens, 0), context_limit, COALESCE(allowed_roles, '{}')
+FROM AI.FN_List_Models();`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Model
+	for rows.Next() {
+		var m Model
+		err = rows.Scan(&m.Alias, &m.Provider, &m.UpstreamID, &m.Temperature, &m.MaxTokens, &m.ContextLimit, &m.AllowedRoles)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, m)
+	}
+	return list, rows.Err()
+}
+
+func (r *Registry) Get(alias string) (Model, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	m, ok := r.models[alias]
+	return m, ok
+}
+
+// List returns the models the role may use, ordered by alias
+func (r *Registry) List(role string) []Model {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	list := []Model{}
+	for _, m := range r.models {
+		if m.Allows(role) {
+			list = append(list, m)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Alias < list[j].Alias })
+	return list
+}
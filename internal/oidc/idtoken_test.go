@@ -0,0 +1,449 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testIssuer serves discovery, a JWKS for the keys it signs with and a token endpoint for
+// the codes handed out by authorize. Adding a key rotates to it.
+type testIssuer struct {
+	srv          *httptest.Server
+	clientSecret string
+	jwksCalls    int32
+
+	mu    sync.Mutex
+	keys  map[string]crypto.Signer
+	codes map[string]authorization
+}
+
+// authorization is what the issuer remembers about a code until it is redeemed
+type authorization struct {
+	challenge   string
+	redirectURI string
+	idToken     string
+}
+
+const testRedirectURL = "https://grimoire.example.com/api/auth/oidc/callback"
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+
+	iss := &testIssuer{clientSecret: "s3cret:/+&", keys: map[string]crypto.Signer{}, codes: map[string]authorization{}}
+	iss.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			fmt.Fprintf(w, `{"issuer": %q, "authorization_endpoint": "%[1]s/authorize", "token_endpoint": "%[1]s/token", "jwks_uri": "%[1]s/jwks"}`, iss.srv.URL)
+		case "/jwks":
+			atomic.AddInt32(&iss.jwksCalls, 1)
+			json.NewEncoder(w).Encode(iss.jwks())
+		case "/token":
+			iss.token(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(iss.srv.Close)
+	return iss
+}
+
+// authorize plays the user signing in at authURL and returns the code the issuer redirects back with.
+// The code redeems for an ID token signed with kid, or for no ID token at all when kid is empty.
+func (iss *testIssuer) authorize(t *testing.T, authURL string, kid string) string {
+	t.Helper()
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+
+	var idToken string
+	if kid != "" {
+		claims := iss.claims()
+		claims["nonce"] = q.Get("nonce")
+		idToken = iss.sign(t, kid, claims)
+	}
+
+	code, err := RandomString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss.mu.Lock()
+	iss.codes[code] = authorization{challenge: q.Get("code_challenge"), redirectURI: q.Get("redirect_uri"), idToken: idToken}
+	iss.mu.Unlock()
+	return code
+}
+
+// token redeems a code once, checking the client and the PKCE verifier the way a real issuer would
+func (iss *testIssuer) token(w http.ResponseWriter, r *http.Request) {
+	tokenError := func(status int, code string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"error": %q}`, code)
+	}
+
+	if r.Method != "POST" || r.ParseForm() != nil {
+		tokenError(http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	// RFC 6749 2.3.1: the client ID and secret are form-encoded before going into Basic auth
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	}
+	if !ok || id != "grimoire" || secret != iss.clientSecret || r.PostForm.Get("client_id") != "grimoire" {
+		tokenError(http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	iss.mu.Lock()
+	auth, found := iss.codes[r.PostForm.Get("code")]
+	delete(iss.codes, r.PostForm.Get("code"))
+	iss.mu.Unlock()
+
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+	if !found || r.PostForm.Get("redirect_uri") != auth.redirectURI || CodeChallenge(r.PostForm.Get("code_verifier")) != auth.challenge {
+		tokenError(http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if auth.idToken == "" {
+		fmt.Fprint(w, `{"access_token": "at-1", "token_type": "Bearer", "expires_in": 3600}`)
+		return
+	}
+	fmt.Fprintf(w, `{"access_token": "at-1", "token_type": "Bearer", "expires_in": 3600, "id_token": %q}`, auth.idToken)
+}
+
+func (iss *testIssuer) addRSA(t *testing.T, kid string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss.mu.Lock()
+	iss.keys[kid] = key
+	iss.mu.Unlock()
+}
+
+func (iss *testIssuer) addEC(t *testing.T, kid string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss.mu.Lock()
+	iss.keys[kid] = key
+	iss.mu.Unlock()
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (iss *testIssuer) jwks() map[string]any {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+
+	keys := []map[string]string{}
+	for kid, key := range iss.keys {
+		switch pub := key.Public().(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes())})
+		case *ecdsa.PublicKey:
+			x, y := make([]byte, 32), make([]byte, 32)
+			pub.X.FillBytes(x)
+			pub.Y.FillBytes(y)
+			keys = append(keys, map[string]string{"kty": "EC", "kid": kid, "use": "sig", "crv": "P-256", "x": b64(x), "y": b64(y)})
+		}
+	}
+	return map[string]any{"keys": keys}
+}
+
+// sign returns an ID token for claims signed with the key kid
+func (iss *testIssuer) sign(t *testing.T, kid string, claims map[string]any) string {
+	t.Helper()
+
+	iss.mu.Lock()
+	key := iss.keys[kid]
+	iss.mu.Unlock()
+
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = sig
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signingInput + "." + b64(signature)
+}
+
+func (iss *testIssuer) claims() map[string]any {
+	return map[string]any{
+		"iss":   iss.srv.URL,
+		"sub":   "user-1",
+		"aud":   "grimoire",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": "nonce-1",
+		"email": "user@example.com",
+	}
+}
+
+func (iss *testIssuer) provider() *Provider {
+	return NewProvider(Config{
+		Issuer:       iss.srv.URL,
+		ClientID:     "grimoire",
+		ClientSecret: iss.clientSecret,
+		RedirectURL:  testRedirectURL,
+		Scopes:       []string{"openid", "email", "profile"},
+	})
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	iss := newTestIssuer(t)
+	iss.addRSA(t, "rsa-1")
+	iss.addEC(t, "ec-1")
+	p := iss.provider()
+
+	for _, kid := range []string{"rsa-1", "ec-1"} {
+		t.Run(kid, func(t *testing.T) {
+			claims, err := p.VerifyIDToken(context.Background(), iss.sign(t, kid, iss.claims()), "nonce-1")
+			if err != nil {
+				t.Fatalf("VerifyIDToken: %v", err)
+			}
+			if claims.Subject != "user-1" || claims.Email != "user@example.com" {
+				t.Errorf("claims = %+v", claims)
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenRejects(t *testing.T) {
+	iss := newTestIssuer(t)
+	iss.addRSA(t, "rsa-1")
+	iss.addEC(t, "ec-1")
+	p := iss.provider()
+
+	with := func(key string, value any) map[string]any {
+		c := iss.claims()
+		c[key] = value
+		return c
+	}
+
+	// Tokens whose claims were changed after they were signed
+	tampered, _ := json.Marshal(with("sub", "admin"))
+	rsaToken := strings.Split(iss.sign(t, "rsa-1", iss.claims()), ".")
+	ecToken := strings.Split(iss.sign(t, "ec-1", iss.claims()), ".")
+
+	tests := []struct {
+		name  string
+		token string
+		nonce string
+		want  string
+	}{
+		{"bad rsa signature", rsaToken[0] + "." + b64(tampered) + "." + rsaToken[2], "nonce-1", "invalid signature"},
+		{"bad ec signature", ecToken[0] + "." + b64(tampered) + "." + ecToken[2], "nonce-1", "invalid signature"},
+		{"wrong audience", iss.sign(t, "rsa-1", with("aud", "someone-else")), "nonce-1", "wrong audience"},
+		{"wrong audience in list", iss.sign(t, "ec-1", with("aud", []string{"a", "b"})), "nonce-1", "wrong audience"},
+		{"wrong nonce", iss.sign(t, "rsa-1", iss.claims()), "nonce-2", "wrong nonce"},
+		{"expired", iss.sign(t, "ec-1", with("exp", time.Now().Add(-time.Hour).Unix())), "nonce-1", "expired"},
+		{"wrong issuer", iss.sign(t, "rsa-1", with("iss", "https://evil.example.com")), "nonce-1", "wrong issuer"},
+		{"unknown key", forgeKid(iss.sign(t, "rsa-1", iss.claims()), "rsa-9"), "nonce-1", "unknown key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.VerifyIDToken(context.Background(), tt.token, tt.nonce)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// forgeKid swaps the kid in the header of token, leaving the claims and signature alone
+func forgeKid(token string, kid string) string {
+	parts := strings.Split(token, ".")
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"})
+	return b64(header) + "." + parts[1] + "." + parts[2]
+}
+
+func TestKeyRotation(t *testing.T) {
+	iss := newTestIssuer(t)
+	iss.addRSA(t, "rsa-1")
+	p := iss.provider()
+
+	if _, err := p.VerifyIDToken(context.Background(), iss.sign(t, "rsa-1", iss.claims()), "nonce-1"); err != nil {
+		t.Fatalf("VerifyIDToken: %v", err)
+	}
+
+	// The issuer starts signing with a key the provider hasn't seen, and the JWKS was only just fetched
+	iss.addEC(t, "ec-2")
+	token := iss.sign(t, "ec-2", iss.claims())
+	if _, err := p.VerifyIDToken(context.Background(), token, "nonce-1"); err == nil || !strings.Contains(err.Error(), "unknown key") {
+		t.Fatalf("err = %v, want an unknown key while the JWKS is fresh", err)
+	}
+	if calls := atomic.LoadInt32(&iss.jwksCalls); calls != 1 {
+		t.Errorf("jwks calls = %d, want 1 so an unknown kid can't make us hammer the issuer", calls)
+	}
+
+	// Once the cached keys are stale an unknown kid refetches the JWKS
+	p.mu.Lock()
+	p.keysAt = time.Now().Add(-2 * time.Minute)
+	p.mu.Unlock()
+
+	if _, err := p.VerifyIDToken(context.Background(), token, "nonce-1"); err != nil {
+		t.Fatalf("VerifyIDToken after rotation: %v", err)
+	}
+	if calls := atomic.LoadInt32(&iss.jwksCalls); calls != 2 {
+		t.Errorf("jwks calls = %d, want 2", calls)
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	iss := newTestIssuer(t)
+	p := iss.provider()
+
+	authURL, err := p.AuthCodeURL(context.Background(), "state-1", "nonce-1", "verifier-1")
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("parse %q: %v", authURL, err)
+	}
+	if got := u.Scheme + "://" + u.Host + u.Path; got != iss.srv.URL+"/authorize" {
+		t.Errorf("endpoint = %s, want the authorization endpoint from discovery", got)
+	}
+
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             "grimoire",
+		"redirect_uri":          testRedirectURL,
+		"scope":                 "openid email profile",
+		"state":                 "state-1",
+		"nonce":                 "nonce-1",
+		"code_challenge":        CodeChallenge("verifier-1"),
+		"code_challenge_method": "S256",
+	}
+	q := u.Query()
+	for key, value := range want {
+		if q.Get(key) != value {
+			t.Errorf("%s = %q, want %q", key, q.Get(key), value)
+		}
+	}
+	if len(q) != len(want) {
+		t.Errorf("query = %v, want only %v", q, want)
+	}
+}
+
+func TestCodeChallenge(t *testing.T) {
+	// The example from RFC 7636 appendix B
+	if got := CodeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"); got != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("CodeChallenge = %s", got)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	iss := newTestIssuer(t)
+	iss.addRSA(t, "rsa-1")
+	p := iss.provider()
+
+	authURL, err := p.AuthCodeURL(context.Background(), "state-1", "nonce-2", "verifier-1")
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	code := iss.authorize(t, authURL, "rsa-1")
+
+	claims, err := p.Exchange(context.Background(), code, "verifier-1", "nonce-2")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if claims.Subject != "user-1" || claims.Email != "user@example.com" {
+		t.Errorf("claims = %+v", claims)
+	}
+
+	if _, err := p.Exchange(context.Background(), code, "verifier-1", "nonce-2"); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("err = %v, want a code to be redeemed only once", err)
+	}
+}
+
+func TestExchangeRejects(t *testing.T) {
+	iss := newTestIssuer(t)
+	iss.addRSA(t, "rsa-1")
+
+	tests := []struct {
+		name     string
+		kid      string
+		secret   string
+		verifier string
+		nonce    string
+		want     string
+	}{
+		{"wrong verifier", "rsa-1", iss.clientSecret, "verifier-2", "nonce-1", "returned 400 Bad Request"},
+		{"wrong client secret", "rsa-1", "guess", "verifier-1", "nonce-1", "returned 401 Unauthorized"},
+		{"no client secret", "rsa-1", "", "verifier-1", "nonce-1", "returned 401 Unauthorized"},
+		{"no id token", "", iss.clientSecret, "verifier-1", "nonce-1", "no id_token"},
+		{"wrong nonce", "rsa-1", iss.clientSecret, "verifier-1", "nonce-2", "wrong nonce"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := iss.provider()
+			authURL, err := p.AuthCodeURL(context.Background(), "state-1", "nonce-1", "verifier-1")
+			if err != nil {
+				t.Fatalf("AuthCodeURL: %v", err)
+			}
+			code := iss.authorize(t, authURL, tt.kid)
+
+			p.Config.ClientSecret = tt.secret
+			claims, err := p.Exchange(context.Background(), code, tt.verifier, tt.nonce)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Exchange = %+v, %v, want %q", claims, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+package openai
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type ChatCompletionRequest struct {
+	Model         string         `json:"model"`
+	Messages      []Message      `json:"messages"`
+	Temperature   float64        `json:"temperature"`
+	MaxTokens     int            `json:"max_tokens,omitempty"`
+	Stream        bool           `json:"stream,omitempty"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type Choice struct {
+	Index        int     `json:"index"`
+	Message      Message `json:"message"`
+	FinishReason string  `json:"finish_reason"`
+}
+
+type ChatCompletionResponse struct {
+	ID      string   `json:"id"`
+	Model   string   `json:"model"`
+	Choices []Choice `json:"choices"`
+	Usage   Usage    `json:"usage"`
+}
+
+type ChunkChoice struct {
+	Index        int     `json:"index"`
+	Delta        Message `json:"delta"`
+	FinishReason string  `json:"finish_reason"`
+}
+
+// ChatCompletionChunk is one event of a streamed completion. Usage is only set on the last chunk,
+// and only when the request asked for it with StreamOptions.
+type ChatCompletionChunk struct {
+	ID      string        `json:"id"`
+	Model   string        `json:"model"`
+	Choices []ChunkChoice `json:"choices"`
+	Usage   *Usage        `json:"usage"`
+}
+
+var (
+	// ErrRateLimited is wrapped by an APIError for a 429, after the retries ran out
+	ErrRateLimited = errors.New("openai: rate limited")
+
+	// ErrUnavailable is wrapped by an APIError for a 5xx, after the retries ran out
+	ErrUnavailable = errors.New("openai: unavailable")
+
+	// ErrTimeout is returned when no response arrived before the timeout of the HTTP client
+	ErrTimeout = errors.New("openai: timed out")
+
+	// ErrNotAccepted matches the error of a stream that failed before the API answered with an OK, so
+	// nothing was generated
+	ErrNotAccepted = errors.New("openai: not accepted")
+)
+
+type notAcceptedError struct {
+	err error
+}
+
+func (e *notAcceptedError) Error() string        { return e.err.Error() }
+func (e *notAcceptedError) Unwrap() error        { return e.err }
+func (e *notAcceptedError) Is(target error) bool { return target == ErrNotAccepted }
+
+// APIError is an error response from the API. RetryAfter is how long the API asked to be left alone
+// for, and is 0 when it didn't say.
+type APIError struct {
+	StatusCode int
+	Type       string
+	Code       string
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("openai: %d %s (%s): %s", e.StatusCode, e.Type, e.Code, e.Message)
+	}
+	return fmt.Sprintf("openai: %d %s: %s", e.StatusCode, e.Type, e.Message)
+}
+
+func (e *APIError) Unwrap() error {
+	switch {
+	case e.StatusCode == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case e.StatusCode >= 500:
+		return ErrUnavailable
+	}
+	return nil
+}
+
+// Client calls the chat completions API of OpenAI, or of a server that implements it such as Ollama or llama.cpp.
+// Point BaseURL at an httptest server to test against canned responses.
+type Client struct {
+	BaseURL      string
+	APIKey       string
+	Organization string
+	HTTPClient   *http.Client
+
+	// StreamHTTPClient has no overall timeout, since streamed replies can take minutes and are
+	// only limited by the context of the caller
+	StreamHTTPClient *http.Client
+
+	// MaxRetries is how many times a 429 or 5xx is retried. The wait doubles from MinBackoff up to
+	// MaxBackoff, unless the API sends a Retry-After, and a Retry-After longer than MaxBackoff isn't waited out.
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+func New(apiKey string, organization string) *Client {
+	c := NewCompatible("https://api.openai.com/v1", apiKey)
+	c.Organization = organization
+	return c
+}
+
+// NewCompatible is for a server other than OpenAI's, which usually doesn't need an API key
+func NewCompatible(baseURL string, apiKey string) *Client {
+	return &Client{
+		BaseURL:          strings.TrimSuffix(baseURL, "/"),
+		APIKey:           apiKey,
+		HTTPClient:       &http.Client{Timeout: 300 * time.Second},
+		StreamHTTPClient: &http.Client{},
+		MaxRetries:       3,
+		MinBackoff:       500 * time.Millisecond,
+		MaxBackoff:       30 * time.Second,
+	}
+}
+
+func (c *Client) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	req.Stream, req.StreamOptions = false, nil
+
+	resp, err := c.send(ctx, c.HTTPClient, req)
+	if err != nil {
+		return ChatCompletionResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var body ChatCompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return ChatCompletionResponse{}, fmt.Errorf("openai: decode response: %w", err)
+	}
+	if len(body.Choices) == 0 {
+		return ChatCompletionResponse{}, errors.New("openai: no choices in the response")
+	}
+	return body, nil
+}
+
+// CreateChatCompletionStream calls onChunk with each chunk of the reply as it arrives, and stops when onChunk
+// returns an error. It returns io.ErrUnexpectedEOF when the stream ends without [DONE], and an error matching
+// ErrNotAccepted when it fails before the stream starts.
+func (c *Client) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest, onChunk func(ChatCompletionChunk) error) error {
+	req.Stream = true
+
+	resp, err := c.send(ctx, c.StreamHTTPClient, req)
+	if err != nil {
+		return &notAcceptedError{err}
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			return nil
+		}
+
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("openai: decode chunk: %w", err)
+		}
+		if err := onChunk(chunk); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return wrapTimeout(err)
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// send posts the request, retrying 429s and 5xxs, and returns the response once its status is OK
+func (c *Client) send(ctx context.Context, client *http.Client, body ChatCompletionRequest) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("openai: encode request: %w", err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+"/chat/completions", bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if c.APIKey != "" {
+			req.Header.Set("Authorization", "Bearer "+c.APIKey)
+		}
+		if c.Organization != "" {
+			req.Header.Set("OpenAI-Organization", c.Organization)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, wrapTimeout(err)
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+
+		apiErr := readAPIError(resp)
+		resp.Body.Close()
+
+		retryable := apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= 500
+		if !retryable || attempt >= c.MaxRetries {
+			return nil, apiErr
+		}
+
+		wait := apiErr.RetryAfter
+		if wait == 0 {
+			wait = c.backoff(attempt)
+		} else if wait > c.MaxBackoff {
+			return nil, apiErr
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// backoff doubles from MinBackoff for each attempt, with up to a quarter added at random so that
+// requests rate limited together don't all retry together
+func (c *Client) backoff(attempt int) time.Duration {
+	wait := c.MinBackoff << uint(attempt)
+	if wait <= 0 || wait > c.MaxBackoff {
+		wait = c.MaxBackoff
+	}
+	if wait/4 > 0 {
+		wait += time.Duration(rand.Int63n(int64(wait / 4)))
+	}
+	return wait
+}
+
+// readAPIError reads the error from the body of a failed response, falling back to the raw body when it
+// isn't the JSON error object of the API
+func readAPIError(resp *http.Response) *APIError {
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+		Type:       http.StatusText(resp.StatusCode),
+		RetryAfter: ParseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+			Code    any    `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(raw, &body); err != nil || body.Error.Message == "" {
+		apiErr.Message = strings.TrimSpace(string(raw))
+		return apiErr
+	}
+
+	apiErr.Message = body.Error.Message
+	if body.Error.Type != "" {
+		apiErr.Type = body.Error.Type
+	}
+	if body.Error.Code != nil {
+		apiErr.Code = fmt.Sprint(body.Error.Code)
+	}
+	return apiErr
+}
+
+// ParseRetryAfter reads a Retry-After header, which is either a number of seconds or an HTTP date
+func ParseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(at); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+func wrapTimeout(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: %v", ErrTimeout, err)
+	}
+	return err
+}
@@ -0,0 +1,224 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestClient points a client at handler, with backoffs short enough for tests
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	c := NewCompatible(srv.URL, "sk-test")
+	c.MinBackoff = time.Millisecond
+	c.MaxBackoff = 5 * time.Second
+	return c
+}
+
+var testRequest = ChatCompletionRequest{
+	Model:    "gpt-test",
+	Messages: []Message{{Role: "user", Content: "hello"}},
+}
+
+const okBody = `{"id": "chatcmpl-1", "model": "gpt-test", "choices": [{"index": 0, "message": {"role": "assistant", "content": "hi"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 3, "completion_tokens": 1, "total_tokens": 4}}`
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter func() string
+		minWait    time.Duration
+	}{
+		{"seconds", func() string { return "1" }, 900 * time.Millisecond},
+		{"http date", func() string { return time.Now().Add(2 * time.Second).UTC().Format(http.TimeFormat) }, 900 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			var firstAt, secondAt time.Time
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&calls, 1) == 1 {
+					firstAt = time.Now()
+					w.Header().Set("Retry-After", tt.retryAfter())
+					w.WriteHeader(http.StatusTooManyRequests)
+					fmt.Fprint(w, `{"error": {"message": "slow down", "type": "requests", "code": "rate_limit_exceeded"}}`)
+					return
+				}
+				secondAt = time.Now()
+				fmt.Fprint(w, okBody)
+			})
+
+			resp, err := c.CreateChatCompletion(context.Background(), testRequest)
+			if err != nil {
+				t.Fatalf("CreateChatCompletion: %v", err)
+			}
+			if resp.Choices[0].Message.Content != "hi" {
+				t.Errorf("content = %q, want %q", resp.Choices[0].Message.Content, "hi")
+			}
+			if calls != 2 {
+				t.Errorf("calls = %d, want 2", calls)
+			}
+			if wait := secondAt.Sub(firstAt); wait < tt.minWait {
+				t.Errorf("retried after %v, want at least %v", wait, tt.minWait)
+			}
+		})
+	}
+}
+
+func TestRetryAfterLongerThanMaxBackoff(t *testing.T) {
+	var calls int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	_, err := c.CreateChatCompletion(context.Background(), testRequest)
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("err = %v, want ErrRateLimited", err)
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.RetryAfter != time.Hour {
+		t.Errorf("err = %#v, want an APIError with RetryAfter of an hour", err)
+	}
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+}
+
+func TestServerErrorRetriesRunOut(t *testing.T) {
+	var calls int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, "upstream connect error")
+	})
+	c.MaxRetries = 2
+
+	_, err := c.CreateChatCompletion(context.Background(), testRequest)
+	if !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("err = %v, want ErrUnavailable", err)
+	}
+	if calls != 3 {
+		t.Errorf("calls = %d, want 3", calls)
+	}
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %v, want an APIError", err)
+	}
+	if apiErr.StatusCode != http.StatusBadGateway || apiErr.Message != "upstream connect error" {
+		t.Errorf("err = %+v, want the status and raw body", apiErr)
+	}
+}
+
+func TestErrorBody(t *testing.T) {
+	var calls int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error": {"message": "This model's maximum context length is 8192 tokens.", "type": "invalid_request_error", "param": "messages", "code": "context_length_exceeded"}}`)
+	})
+
+	_, err := c.CreateChatCompletion(context.Background(), testRequest)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %v, want an APIError", err)
+	}
+	want := APIError{
+		StatusCode: http.StatusBadRequest,
+		Type:       "invalid_request_error",
+		Code:       "context_length_exceeded",
+		Message:    "This model's maximum context length is 8192 tokens.",
+	}
+	if *apiErr != want {
+		t.Errorf("err = %+v, want %+v", *apiErr, want)
+	}
+	if errors.Is(err, ErrRateLimited) || errors.Is(err, ErrUnavailable) {
+		t.Errorf("err = %v, a 400 shouldn't match a retryable error", err)
+	}
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1 since a 400 isn't retried", calls)
+	}
+}
+
+func TestEmptyChoices(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id": "chatcmpl-1", "choices": [], "usage": {"prompt_tokens": 3, "completion_tokens": 0}}`)
+	})
+
+	_, err := c.CreateChatCompletion(context.Background(), testRequest)
+	if err == nil {
+		t.Fatal("err = nil, want an error for a response without choices")
+	}
+}
+
+func TestStreamWithoutDone(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\": [{\"index\": 0, \"delta\": {\"content\": \"Hel\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\": [{\"index\": 0, \"delta\": {\"content\": \"lo\"}}]}\n\n")
+	})
+
+	var reply string
+	err := c.CreateChatCompletionStream(context.Background(), testRequest, func(chunk ChatCompletionChunk) error {
+		for _, choice := range chunk.Choices {
+			reply += choice.Delta.Content
+		}
+		return nil
+	})
+	if !errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ErrNotAccepted) {
+		t.Errorf("err = %v, want io.ErrUnexpectedEOF from a stream that was accepted", err)
+	}
+	if reply != "Hello" {
+		t.Errorf("reply = %q, want the chunks sent before the stream ended", reply)
+	}
+}
+
+func TestStreamNotAccepted(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error": {"message": "bad request", "type": "invalid_request_error"}}`)
+	})
+
+	err := c.CreateChatCompletionStream(context.Background(), testRequest, func(chunk ChatCompletionChunk) error {
+		return nil
+	})
+	var apiErr *APIError
+	if !errors.Is(err, ErrNotAccepted) || !errors.As(err, &apiErr) {
+		t.Errorf("err = %v, want an APIError matching ErrNotAccepted", err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\": [{\"index\": 0, \"delta\": {\"content\": \"hi\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\": [], \"usage\": {\"prompt_tokens\": 3, \"completion_tokens\": 1}}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	})
+
+	var usage *Usage
+	err := c.CreateChatCompletionStream(context.Background(), testRequest, func(chunk ChatCompletionChunk) error {
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("CreateChatCompletionStream: %v", err)
+	}
+	if usage == nil || usage.PromptTokens != 3 || usage.CompletionTokens != 1 {
+		t.Errorf("usage = %+v, want 3 prompt and 1 completion tokens", usage)
+	}
+}
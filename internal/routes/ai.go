@@ -1,40 +1,218 @@
 package routes
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/liamrlawrence/sigil-rest_api/internal/dberr"
+	"github.com/liamrlawrence/sigil-rest_api/internal/llm"
 	"github.com/liamrlawrence/sigil-rest_api/internal/logging"
+	"github.com/liamrlawrence/sigil-rest_api/internal/models"
 	"github.com/liamrlawrence/sigil-rest_api/internal/server"
 	"log"
+	"math"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
-	"time"
 )
 
-func ChatGPTRequest(s *server.Server, GptModel string, GptTemperature float32) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		switch GptModel {
-		case "gpt-3.5-turbo":
-			logging.APIEndpoint(r, "POST", fmt.Sprintf("/api/ai/gpt3 | %v %v", GptModel, GptTemperature))
-		case "gpt-4-0314":
-			logging.APIEndpoint(r, "POST", fmt.Sprintf("/api/ai/gpt4 | %v %v", GptModel, GptTemperature))
+// ChatProvider returns the provider that runs the model, or writes an error response when it isn't configured
+func ChatProvider(s *server.Server, w http.ResponseWriter, model models.Model) (llm.Provider, bool) {
+	provider, ok := s.Providers.Get(model.Provider)
+	if !ok {
+		log.Printf("ChatProvider | model '%s' needs provider '%s', which isn't configured\n", model.Alias, model.Provider)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, `{
+	"status": "failed",
+	"message": "model '%s' is unavailable"
+}`, model.Alias)
+	}
+	return provider, ok
+}
+
+// WantsStream reports whether the caller asked for the reply as server-sent events
+func WantsStream(r *http.Request, stream bool) bool {
+	return stream || r.URL.Query().Get("stream") == "true" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// StreamChat relays the reply of the model to the caller as server-sent events: a "delta" event for each piece of
+// the reply, then a "done" event carrying what finish returns. finish is called once the stream ends, even when it
+// was cut off by either side, so that every token that was generated gets billed. Only a request the provider
+// never accepted goes unbilled.
+func StreamChat(w http.ResponseWriter, r *http.Request, provider llm.Provider, req llm.Request, finish func(res llm.Response) any) {
+	events := NewEventStream(w)
+	res, err := provider.ChatStream(r.Context(), req, func(delta string) error {
+		return events.Send("delta", map[string]string{"content": delta})
+	})
+	if err != nil {
+		log.Printf("%s | %v\n", r.URL.Path, err)
+	}
+
+	// The provider refused the request so nothing was charged, unless the caller hung up while it was being
+	// sent, when the provider may have taken it anyway
+	if errors.Is(err, llm.ErrNotAccepted) && r.Context().Err() == nil {
+		writeUpstreamError(w, err)
+		return
+	}
+
+	if res.Usage == (llm.Usage{}) {
+		res.Usage = llm.EstimateUsage(req.Messages, res.Content)
+	}
+	done := finish(res)
+	if err != nil && !events.Started() {
+		writeUpstreamError(w, err)
+		return
+	}
+	if err != nil {
+		events.Send("error", map[string]string{"message": "the reply was cut off"})
+	}
+	events.Send("done", done)
+}
+
+// Bill is a call charged in Postgres. Cost is in dollars, at the price the model had in AI.Model_Prices when
+// the bill was inserted, and is nil when the model has no price.
+type Bill struct {
+	ID   int64
+	Cost *float64
+}
+
+// BilledUsage is the usage block returned with a reply
+type BilledUsage struct {
+	llm.Usage
+	Cost *float64 `json:"cost"`
+}
+
+// InsertGPTBill logs the expenses of a call in Postgres against the session or API key of the caller
+func InsertGPTBill(s *server.Server, session Session, name string, upstreamID string, usage llm.Usage) (Bill, error) {
+	billQuery, billOwner := "CALL SP_Insert_GPT_Bill($1, $2, $3, $4, $5, NULLIF($6, ''), NULL, NULL);", session.ID
+	if session.IsAPIKey() {
+		billQuery, billOwner = "CALL SP_Insert_GPT_Bill_API_Key($1, $2, $3, $4, $5, NULLIF($6, ''), NULL, NULL);", session.APIKeyID
+	}
+
+	var bill Bill
+	err := s.DBPool.QueryRow(context.Background(), billQuery,
+		billOwner, name, upstreamID, usage.PromptTokens, usage.CompletionTokens, session.ImpersonatedBy).Scan(&bill.ID, &bill.Cost)
+	if err != nil {
+		return Bill{}, fmt.Errorf("insert gpt bill: %w", err)
+	}
+	if bill.Cost == nil {
+		log.Printf("InsertGPTBill | bill %d for '%s' has no cost, add a price for the model\n", bill.ID, upstreamID)
+	}
+	return bill, nil
+}
+
+// ChatParameters builds the request for the model, applying the overrides from the caller to the defaults of the
+// model, and dropping the oldest exchanges after the first system message until the rest and the reply fit in the
+// context of the model. It returns false when the parameters are out of range or the last message doesn't fit on its own.
+func ChatParameters(model models.Model, messages []llm.Message, temperature *float64, maxTokens *int) (llm.Request, bool) {
+	req := llm.Request{
+		Model:       model.UpstreamID,
+		Temperature: model.Temperature,
+		MaxTokens:   model.MaxTokens,
+	}
+	if temperature != nil {
+		req.Temperature = *temperature
+	}
+	if maxTokens != nil {
+		req.MaxTokens = *maxTokens
+	}
+	if req.Temperature < 0 || req.Temperature > 2 || req.MaxTokens < 0 || req.MaxTokens > model.ContextLimit {
+		return llm.Request{}, false
+	}
+
+	var system []llm.Message
+	if len(messages) > 0 && messages[0].Role == "system" {
+		system, messages = []llm.Message{messages[0]}, messages[1:]
+	}
+
+	total := req.MaxTokens
+	for _, m := range append(system, messages...) {
+		total += llm.EstimateTokens(m.Content)
+	}
+	trimmed := false
+	for total > model.ContextLimit && len(messages) > 1 {
+		total -= llm.EstimateTokens(messages[0].Content)
+		messages = messages[1:]
+		trimmed = true
+	}
+	// History is trimmed a whole exchange at a time, since some providers refuse one that starts with a reply
+	for trimmed && messages[0].Role != "user" && len(messages) > 1 {
+		total -= llm.EstimateTokens(messages[0].Content)
+		messages = messages[1:]
+	}
+	if total > model.ContextLimit || len(messages) == 0 {
+		return llm.Request{}, false
+	}
+
+	req.Messages = append(system, messages...)
+	return req, true
+}
+
+// writeUnknownModel writes a 404 for an alias that doesn't exist or that the caller may not use, the alias
+// comes from the request so the message is marshalled rather than formatted in
+func writeUnknownModel(w http.ResponseWriter, alias string) {
+	message, _ := json.Marshal(fmt.Sprintf("unknown model '%s'", alias))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, `{
+	"status": "failed",
+	"message": %s
+}`, message)
+}
+
+func writeChatParametersInvalid(w http.ResponseWriter, model models.Model) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprintf(w, `{
+	"status": "failed",
+	"message": "'temperature' must be between 0 and 2, and the message and 'max_tokens' must fit in the %d token context of '%s'"
+}`, model.ContextLimit, model.Alias)
+}
+
+// writeUpstreamError passes a rate limit on to the caller as a 429 and a timeout as a 504, with any other failure of the model as a 502
+func writeUpstreamError(w http.ResponseWriter, err error) {
+	status, message := http.StatusBadGateway, "failed to get a reply from the model"
+	switch {
+	case errors.Is(err, llm.ErrRateLimited):
+		status, message = http.StatusTooManyRequests, "the model is rate limited, try again later"
+		var llmErr *llm.Error
+		if errors.As(err, &llmErr) && llmErr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(llmErr.RetryAfter.Seconds()))))
 		}
+	case errors.Is(err, llm.ErrTimeout):
+		status, message = http.StatusGatewayTimeout, "the model took too long to reply"
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{
+	"status": "failed",
+	"message": "%s"
+}`, message)
+}
 
+// ChatRequest sends a single message to the model the alias resolves to, and bills the usage to the caller.
+// With an empty alias the model is taken from the request body.
+func ChatRequest(s *server.Server, alias string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
 		// Parse the request from the user
 		type RequestBody struct {
-			Name    string `json:"name"`
-			Message string `json:"message"`
+			Model       string   `json:"model"`
+			Name        string   `json:"name"`
+			Message     string   `json:"message"`
+			Temperature *float64 `json:"temperature"`
+			MaxTokens   *int     `json:"max_tokens"`
+			Stream      bool     `json:"stream"`
 		}
 
 		var requestBody RequestBody
 
 		err := json.NewDecoder(r.Body).Decode(&requestBody)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
 			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
 			fmt.Fprintf(w, `{
 	"status": "failed",
 	"message": "failed to read request body"
@@ -42,119 +220,171 @@ func ChatGPTRequest(s *server.Server, GptModel string, GptTemperature float32) f
 			return
 		}
 
-		if requestBody.Message == "" || requestBody.Name == "" {
-			w.WriteHeader(http.StatusBadRequest)
+		modelAlias := alias
+		if modelAlias == "" {
+			modelAlias = requestBody.Model
+		}
+		if requestBody.Message == "" || requestBody.Name == "" || modelAlias == "" {
 			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
 			fmt.Fprintf(w, `{
 	"status": "failed",
-	"message": "request body requires fields 'message' and 'name'"
+	"message": "request body requires fields 'model', 'message' and 'name'"
 }`)
 			return
 		}
 
-		// Set up the GPT API request
-		var OpenaiApiKey = os.Getenv("OPENAI_API_KEY")
-
-		client := &http.Client{
-			Timeout: 300 * time.Second,
+		session, _ := SessionFromContext(r.Context())
+		model, ok := s.Models.Get(modelAlias)
+		if !ok || !model.Allows(session.Role) {
+			writeUnknownModel(w, modelAlias)
+			return
 		}
 
-		data := []byte(fmt.Sprintf(`{
-	"model": "%v",
-	"messages": [{
-		"role": "user",
-		"content": "%v"
-	}],
-	"temperature": %v
-}`,
-			GptModel, strings.Replace(strings.Replace(requestBody.Message, "\n", " ", -1), "\"", "\\\"", -1), GptTemperature))
-		req, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(data))
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Header().Set("Content-Type", "application/json; charset=utf-8")
-			fmt.Fprintf(w, `{
-	"status": "failed",
-	"message": "failed to create GPT API request"
-}`)
+		provider, ok := ChatProvider(s, w, model)
+		if !ok {
 			return
 		}
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", "Bearer "+OpenaiApiKey)
 
-		// Send request
-		gptResp, err := client.Do(req)
-
-		// Parse the GPT API response
-		type Message struct {
-			Content string `json:"content"`
-			Role    string `json:"role"`
+		// Request parameters override the defaults of the model
+		req, ok := ChatParameters(model, []llm.Message{{Role: "user", Content: requestBody.Message}},
+			requestBody.Temperature, requestBody.MaxTokens)
+		if !ok {
+			writeChatParametersInvalid(w, model)
+			return
 		}
 
-		type Choice struct {
-			FinishReason string  `json:"finish_reason"`
-			Index        int     `json:"index"`
-			Message      Message `json:"message"`
-		}
+		GptModel := model.UpstreamID
+		logging.APIEndpoint(r, "POST", fmt.Sprintf("%s | %v %v %v %v", r.URL.Path, modelAlias, model.Provider, GptModel, req.Temperature))
 
-		type Usage struct {
-			CompletionTokens int `json:"completion_tokens"`
-			PromptTokens     int `json:"prompt_tokens"`
-			TotalTokens      int `json:"total_tokens"`
+		if !CheckBudget(s, w, session, requestBody.Name, model, req) {
+			return
 		}
 
-		type ChatCompletionResponse struct {
-			Choices []Choice `json:"choices"`
-			Created float64  `json:"created"`
-			ID      string   `json:"id"`
-			Model   string   `json:"model"`
-			Object  string   `json:"object"`
-			Usage   Usage    `json:"usage"`
+		if WantsStream(r, requestBody.Stream) {
+			StreamChat(w, r, provider, req, func(res llm.Response) any {
+				bill, err := InsertGPTBill(s, session, requestBody.Name, GptModel, res.Usage)
+				if err != nil {
+					log.Printf("%s | %v\n", r.URL.Path, err)
+				}
+				return map[string]any{"usage": BilledUsage{res.Usage, bill.Cost}, "model": GptModel}
+			})
+			return
 		}
 
-		var responseBody ChatCompletionResponse
-
-		err = json.NewDecoder(gptResp.Body).Decode(&responseBody)
+		res, err := provider.Chat(r.Context(), req)
 		if err != nil {
-			http.Error(w, "Failed to read GPT API response body", http.StatusBadRequest)
+			log.Printf("%s | %v\n", r.URL.Path, err)
+			writeUpstreamError(w, err)
 			return
 		}
+		reply, usage := res.Content, res.Usage
 
-		// Log the expenses in Postgres
-		sessionID := r.Header.Get("X-Grimoire-Token")
-		conn, err := s.DBPool.Query(context.Background(), "CALL SP_Insert_GPT_Bill($1, $2, $3, $4, $5);",
-			sessionID, requestBody.Name, GptModel, responseBody.Usage.PromptTokens, responseBody.Usage.CompletionTokens)
+		// The reply has been paid for whether or not the bill is recorded, so the caller still gets it
+		bill, err := InsertGPTBill(s, session, requestBody.Name, GptModel, usage)
 		if err != nil {
-			log.Fatalf("Failed to execute query: %v", err)
+			log.Printf("%s | %v\n", r.URL.Path, err)
 		}
-		defer conn.Close()
+		cost, _ := json.Marshal(bill.Cost)
+		message, _ := json.Marshal(reply)
 
 		// Return `message` and `usage` back to the user
-		//fmt.Printf("\nDEBUG1: %v\n\n", responseBody.Choices[0].Message.Content)
-		//fmt.Printf("\nDEBUG2: %v\n\n", strings.Replace(strings.Replace(responseBody.Choices[0].Message.Content, "\n", "\\n", -1), "\"", "\\\"", -1))
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		fmt.Fprint(w, fmt.Sprintf(`{
-	"message": "%v",
+	"message": %s,
 	"usage": {
 		"prompt_tokens": %v,
-		"completion_tokens": %v
+		"completion_tokens": %v,
+		"cost": %s
 	},
 	"model": "%v"
 }`,
-			strings.Replace(strings.Replace(responseBody.Choices[0].Message.Content, "\n", "\\n", -1), "\"", "\\\"", -1),
-			responseBody.Usage.PromptTokens,
-			responseBody.Usage.CompletionTokens, GptModel))
+			message,
+			usage.PromptTokens,
+			usage.CompletionTokens, cost, GptModel))
 		return
 	}
 }
 
+func HandlerRouteAIChat(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return ChatRequest(s, "")
+}
+
+// HandlerRouteChatGPT35_Turbo is /api/ai/gpt3, kept for older clients as the "gpt3" model alias
 func HandlerRouteChatGPT35_Turbo(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
-	return ChatGPTRequest(s, "gpt-3.5-turbo", 0.7)
+	return ChatRequest(s, "gpt3")
 }
 
+// HandlerRouteChatGPT4 is /api/ai/gpt4, kept for older clients as the "gpt4" model alias
 func HandlerRouteChatGPT4(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
-	return ChatGPTRequest(s, "gpt-4-0314", 0.7)
+	return ChatRequest(s, "gpt4")
+}
+
+// ListedModel is a model as callers see it, with the price it is billed at from AI.Model_Prices.
+// The prices are nil when the model has none.
+type ListedModel struct {
+	models.Model
+	InputPrice  *float64 `json:"input_price"`
+	OutputPrice *float64 `json:"output_price"`
 }
 
+// HandlerRouteAIModels lists the models the caller may use, with their current prices
+func HandlerRouteAIModels(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logging.APIEndpoint(r, "GET", "/api/ai/models")
+
+		session, _ := SessionFromContext(r.Context())
+		list := []ListedModel{}
+		for _, model := range s.Models.List(session.Role) {
+			m := ListedModel{Model: model}
+			err := s.DBPool.QueryRow(context.Background(), "SELECT input_price, output_price FROM AI.FN_Current_Model_Price($1);",
+				model.UpstreamID).Scan(&m.InputPrice, &m.OutputPrice)
+			if err != nil && dberr.From(err) != dberr.ErrNotFound {
+				log.Printf("/api/ai/models | %v\n", err)
+				dberr.From(err).WriteJSON(w)
+				return
+			}
+			list = append(list, m)
+		}
+
+		data, _ := json.Marshal(list)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{
+	"status": "success",
+	"message": "got models",
+	"data": %s
+}`, data)
+	}
+}
+
+// HandlerRouteAdminReloadModels reloads the model registry after the models file or table has changed
+func HandlerRouteAdminReloadModels(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logging.APIEndpoint(r, "POST", "/api/admin/ai/models/reload")
+
+		err := s.Models.Load(r.Context())
+		if err != nil {
+			log.Printf("/api/admin/ai/models/reload | %v\n", err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, `{
+	"status": "failed",
+	"message": "failed to reload models, the previous models are still in use"
+}`)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{
+	"status": "success",
+	"message": "models reloaded"
+}`)
+	}
+}
+
+// HandlerRouteAIBills returns every bill from View_AI_Bills, including what each cost in dollars, along with the total spend
 func HandlerRouteAIBills(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logging.APIEndpoint(r, "GET", "/api/ai/bills")
@@ -178,12 +408,17 @@ func HandlerRouteAIBills(s *server.Server) func(w http.ResponseWriter, r *http.R
 		}
 
 		rowDelimiter := "~~"
-		bills := fmt.Sprintf("%s,%s,%s,%s,%s%s", columns[0], columns[1], columns[2], columns[3], columns[4], rowDelimiter)
+		bills := strings.Join(columns, ",") + rowDelimiter
 
-		// Get the column values
-		values := make([]string, len(columns))
+		// Get the column values, a bill without a price has an empty cost
+		values := make([]*string, len(columns))
+		dest := make([]any, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		row := make([]string, len(columns))
 		for rows.Next() {
-			err := rows.Scan(&values[0], &values[1], &values[2], &values[3], &values[4])
+			err := rows.Scan(dest...)
 			if err != nil {
 				w.WriteHeader(http.StatusBadRequest)
 				w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -193,18 +428,31 @@ func HandlerRouteAIBills(s *server.Server) func(w http.ResponseWriter, r *http.R
 }`)
 				return
 			}
-			bills += fmt.Sprintf("%s,%s,%s,%s,%s%s", values[0], values[1], values[2], values[3], values[4], rowDelimiter)
+			for i, v := range values {
+				row[i] = ""
+				if v != nil {
+					row[i] = *v
+				}
+			}
+			bills += strings.Join(row, ",") + rowDelimiter
 		}
 		bills = bills[:len(bills)-2]
 
+		var totalCost float64
+		err = s.DBPool.QueryRow(context.Background(), "SELECT COALESCE(SUM(cost), 0)::FLOAT8 FROM View_AI_Bills;").Scan(&totalCost)
+		if err != nil {
+			log.Printf("/api/ai/bills | %v\n", err)
+		}
+
 		// Return the query
 		w.WriteHeader(http.StatusOK)
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		fmt.Fprintf(w, `{
 	"status": "success",
 	"message": "got table of AI bills",
-    "data": "%v"
-}`, bills)
+    "data": "%v",
+	"total_cost": %v
+}`, bills, totalCost)
 		return
 	}
 }
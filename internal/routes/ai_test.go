@@ -0,0 +1,137 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/liamrlawrence/sigil-rest_api/internal/llm"
+	"github.com/liamrlawrence/sigil-rest_api/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// stubProvider streams deltas, then returns res and err
+type stubProvider struct {
+	deltas []string
+	res    llm.Response
+	err    error
+}
+
+func (p stubProvider) Chat(ctx context.Context, req llm.Request) (llm.Response, error) {
+	return p.res, p.err
+}
+
+func (p stubProvider) ChatStream(ctx context.Context, req llm.Request, onDelta func(string) error) (llm.Response, error) {
+	for _, d := range p.deltas {
+		if err := onDelta(d); err != nil {
+			return p.res, err
+		}
+	}
+	return p.res, p.err
+}
+
+// refusingAnthropic is an Anthropic provider whose upstream answers every request with status
+func refusingAnthropic(t *testing.T, status int) *llm.Anthropic {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"type": "error", "error": {"type": "invalid_request_error", "message": "refused"}}`)
+	}))
+	t.Cleanup(srv.Close)
+	return &llm.Anthropic{BaseURL: srv.URL, Client: srv.Client(), StreamClient: srv.Client()}
+}
+
+func TestStreamChatBilling(t *testing.T) {
+	req := llm.Request{Model: "test", Messages: []llm.Message{{Role: "user", Content: "hello there"}}}
+	cutOff := errors.New("connection reset")
+
+	tests := []struct {
+		name       string
+		provider   llm.Provider
+		hangUp     bool
+		wantBilled bool
+		wantStatus int
+		wantBody   string
+	}{
+		{"refused by the provider", refusingAnthropic(t, http.StatusBadRequest), false, false, http.StatusBadGateway, "failed to get a reply"},
+		{"rate limited by the provider", refusingAnthropic(t, http.StatusTooManyRequests), false, false, http.StatusTooManyRequests, "rate limited"},
+		{"caller hung up while sending", refusingAnthropic(t, http.StatusOK), true, true, 0, ""},
+		{"failed before the first token", stubProvider{err: cutOff}, false, true, http.StatusBadGateway, "failed to get a reply"},
+		{"cut off after the first token", stubProvider{deltas: []string{"hi"}, res: llm.Response{Content: "hi", Usage: llm.Usage{PromptTokens: 4, CompletionTokens: 1}}, err: cutOff}, false, true, http.StatusOK, "event: error"},
+		{"finished", stubProvider{deltas: []string{"hi"}, res: llm.Response{Content: "hi", Usage: llm.Usage{PromptTokens: 4, CompletionTokens: 1}}}, false, true, http.StatusOK, "event: done"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.hangUp {
+				cancel()
+			}
+			r := httptest.NewRequest("POST", "/api/ai/chat", nil).WithContext(ctx)
+			w := httptest.NewRecorder()
+
+			var billed *llm.Response
+			StreamChat(w, r, tt.provider, req, func(res llm.Response) any {
+				billed = &res
+				return map[string]any{"usage": res.Usage}
+			})
+
+			if (billed != nil) != tt.wantBilled {
+				t.Fatalf("billed = %v, want %v", billed != nil, tt.wantBilled)
+			}
+			if billed != nil && billed.Usage.PromptTokens == 0 {
+				t.Errorf("billed usage = %+v, want at least the prompt", billed.Usage)
+			}
+			if tt.hangUp {
+				return
+			}
+			if w.Code != tt.wantStatus || !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("response = %d %s, want %d containing %q", w.Code, w.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestChatParametersTrimsWholeExchanges(t *testing.T) {
+	// Each message is 30 characters, which estimates at 11 tokens
+	msg := strings.Repeat("x", 30)
+	messages := []llm.Message{
+		{Role: "system", Content: msg},
+		{Role: "user", Content: msg},
+		{Role: "assistant", Content: msg},
+		{Role: "user", Content: msg},
+		{Role: "assistant", Content: msg},
+		{Role: "user", Content: msg},
+	}
+
+	tests := []struct {
+		name      string
+		limit     int
+		wantRoles string
+	}{
+		{"fits", 66, "system user assistant user assistant user"},
+		{"drops the first exchange", 55, "system user assistant user"},
+		{"drops two exchanges", 33, "system user"},
+		{"keeps the last message", 22, "system user"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, ok := ChatParameters(models.Model{ContextLimit: tt.limit}, messages, nil, nil)
+			if !ok {
+				t.Fatal("ok = false, want the messages trimmed to fit")
+			}
+			var roles []string
+			for _, m := range req.Messages {
+				roles = append(roles, m.Role)
+			}
+			if got := strings.Join(roles, " "); got != tt.wantRoles {
+				t.Errorf("roles = %s, want %s", got, tt.wantRoles)
+			}
+		})
+	}
+}
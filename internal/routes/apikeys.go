@@ -0,0 +1,220 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/liamrlawrence/sigil-rest_api/internal/audit"
+	"github.com/liamrlawrence/sigil-rest_api/internal/dberr"
+	"github.com/liamrlawrence/sigil-rest_api/internal/logging"
+	"github.com/liamrlawrence/sigil-rest_api/internal/server"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const apiKeyPrefix = "grim_"
+
+func BearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < len("Bearer ") || !strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return "", false
+	}
+
+	token := strings.TrimSpace(header[len("Bearer "):])
+	return token, token != ""
+}
+
+// AuthenticateAPIKey validates an API key and passes the request on with the key owner attached to the context
+func AuthenticateAPIKey(s *server.Server, apiKey string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var session Session
+		err := s.DBPool.QueryRow(context.Background(), "SELECT key_id::TEXT, username, role, scopes FROM Auth.FN_Valid_API_Key($1, $2::INET);",
+			HashToken(apiKey), ClientIP(r)).Scan(&session.APIKeyID, &session.Username, &session.Role, &session.Scopes)
+		if err != nil {
+			log.Printf("AuthenticateAPIKey | %v\n", err)
+			dberr.From(err).WriteJSON(w)
+			return
+		}
+
+		next.ServeHTTP(w, withSession(r, session))
+	})
+}
+
+func HandlerRouteAuthCreateAPIKey(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type RequestBody struct {
+			Name          string   `json:"name"`
+			Scopes        []string `json:"scopes"`
+			ExpiresInDays int      `json:"expires_in_days"`
+		}
+
+		var requestBody RequestBody
+		err := json.NewDecoder(r.Body).Decode(&requestBody)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		logging.APIEndpoint(r, "POST", fmt.Sprintf("/api/auth/keys - %s", requestBody.Name))
+
+		if requestBody.Name == "" || len(requestBody.Name) > 64 || len(requestBody.Scopes) == 0 || requestBody.ExpiresInDays < 0 {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "request body requires a 'name' of at most 64 characters and at least one scope in 'scopes'"
+}`)
+			return
+		}
+		for _, scope := range requestBody.Scopes {
+			if !OneOf(scope, apiKeyScopes) {
+				message, _ := json.Marshal(fmt.Sprintf("unknown scope '%s', expected one of: %s", scope, strings.Join(apiKeyScopes, ", ")))
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, `{
+	"status": "failed",
+	"message": %s
+}`, message)
+				return
+			}
+		}
+
+		var expiresAt *time.Time
+		if requestBody.ExpiresInDays > 0 {
+			t := time.Now().AddDate(0, 0, requestBody.ExpiresInDays)
+			expiresAt = &t
+		}
+
+		// Only the hash of the key is stored, so this response is the only time the key can be seen
+		apiKey, apiKeyHash, err := NewOpaqueToken(apiKeyPrefix)
+		if err != nil {
+			log.Printf("/api/auth/keys | %v\n", err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "Unknown error"
+}`)
+			return
+		}
+
+		session, _ := SessionFromContext(r.Context())
+		sessionID := session.ID
+		var keyID string
+		err = s.DBPool.QueryRow(context.Background(), "SELECT Auth.FN_Create_API_Key($1::UUID, $2, $3, $4, $5::TEXT[], $6::TIMESTAMPTZ)::TEXT;",
+			sessionID, requestBody.Name, apiKeyHash, apiKey[:len(apiKeyPrefix)+8], requestBody.Scopes, expiresAt).Scan(&keyID)
+		if err != nil {
+			log.Printf("/api/auth/keys | %v\n", err)
+			dberr.From(err).WriteJSON(w)
+			return
+		}
+
+		RecordAuditEvent(s, r, audit.EventAPIKeyCreated, session.Username, sessionID, audit.OutcomeSuccess,
+			fmt.Sprintf("key %s '%s' with scopes %s", keyID, requestBody.Name, strings.Join(requestBody.Scopes, ",")))
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{
+	"status": "success",
+	"message": "api key created, it will not be shown again",
+	"data": {
+		"key_id": "%v",
+		"api_key": "%v"
+	}
+}`,
+			keyID, apiKey)
+	}
+}
+
+func HandlerRouteAuthAPIKeys(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	type APIKey struct {
+		KeyID      string     `json:"key_id"`
+		Name       string     `json:"name"`
+		Prefix     string     `json:"prefix"`
+		Scopes     []string   `json:"scopes"`
+		CreatedAt  time.Time  `json:"created_at"`
+		LastUsedAt *time.Time `json:"last_used_at"`
+		ExpiresAt  *time.Time `json:"expires_at"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logging.APIEndpoint(r, "GET", "/api/auth/keys")
+
+		session, _ := SessionFromContext(r.Context())
+		rows, err := s.DBPool.Query(context.Background(), "SELECT key_id::TEXT, name, prefix, scopes, created_at, last_used_at, expires_at FROM Auth.FN_List_API_Keys($1::UUID);", session.ID)
+		if err != nil {
+			log.Printf("/api/auth/keys | %v\n", err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "failed to get api keys"
+}`)
+			return
+		}
+		defer rows.Close()
+
+		apiKeys := []APIKey{}
+		for rows.Next() {
+			var apiKey APIKey
+			err = rows.Scan(&apiKey.KeyID, &apiKey.Name, &apiKey.Prefix, &apiKey.Scopes, &apiKey.CreatedAt, &apiKey.LastUsedAt, &apiKey.ExpiresAt)
+			if err != nil {
+				break
+			}
+			apiKeys = append(apiKeys, apiKey)
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		if err != nil {
+			log.Printf("/api/auth/keys | %v\n", err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "failed to get api keys during query"
+}`)
+			return
+		}
+
+		data, _ := json.Marshal(apiKeys)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{
+	"status": "success",
+	"message": "got api keys",
+	"data": %s
+}`, data)
+	}
+}
+
+func HandlerRouteAuthRevokeAPIKey(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keyID := chi.URLParam(r, "keyID")
+		logging.APIEndpoint(r, "DELETE", fmt.Sprintf("/api/auth/keys/%s", keyID))
+
+		session, _ := SessionFromContext(r.Context())
+		sessionID := session.ID
+		_, err := s.DBPool.Exec(context.Background(), "CALL Auth.SP_Revoke_API_Key($1::UUID, $2::UUID);", sessionID, keyID)
+		if err != nil {
+			log.Printf("/api/auth/keys | %v\n", err)
+			dbErr := dberr.From(err)
+			if dbErr == dberr.ErrMalformedID {
+				dbErr = dberr.ErrAPIKeyNotFound
+			}
+			dbErr.WriteJSON(w)
+			return
+		}
+		RecordAuditEvent(s, r, audit.EventAPIKeyRevoked, session.Username, sessionID, audit.OutcomeSuccess, fmt.Sprintf("key %s", keyID))
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{
+	"status": "success",
+	"message": "api key revoked"
+}`)
+	}
+}
@@ -0,0 +1,150 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/liamrlawrence/sigil-rest_api/internal/audit"
+	"github.com/liamrlawrence/sigil-rest_api/internal/logging"
+	"github.com/liamrlawrence/sigil-rest_api/internal/server"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	auditPageDefault = 50
+	auditPageMax     = 500
+)
+
+// RecordAuditEvent records an auth event along with the client address and user agent of the request, and
+// the admin behind it when the request comes from an impersonated session
+func RecordAuditEvent(s *server.Server, r *http.Request, eventType audit.EventType, username string, sessionID string, outcome string, detail string) {
+	session, _ := SessionFromContext(r.Context())
+	audit.Record(context.Background(), s.DBPool, audit.Event{
+		Type:           eventType,
+		Username:       username,
+		IP:             ClientIP(r),
+		UserAgent:      r.UserAgent(),
+		SessionID:      sessionID,
+		Outcome:        outcome,
+		Detail:         detail,
+		ImpersonatedBy: session.ImpersonatedBy,
+	})
+}
+
+// HandlerRouteAdminAuditEvents returns audit events, newest first, filtered by the username, type, since and until
+// query parameters and paginated with limit and offset
+func HandlerRouteAdminAuditEvents(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	type AuditEvent struct {
+		EventID        int64     `json:"event_id"`
+		OccurredAt     time.Time `json:"occurred_at"`
+		EventType      string    `json:"event_type"`
+		Username       *string   `json:"username"`
+		IPAddress      *string   `json:"ip_address"`
+		UserAgent      *string   `json:"user_agent"`
+		SessionHash    *string   `json:"session_hash"`
+		Outcome        string    `json:"outcome"`
+		Detail         *string   `json:"detail"`
+		ImpersonatedBy *string   `json:"impersonated_by"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logging.APIEndpoint(r, "GET", "/api/admin/audit")
+
+		query := r.URL.Query()
+
+		var username, eventType *string
+		if v := query.Get("username"); v != "" {
+			username = &v
+		}
+		if v := query.Get("type"); v != "" {
+			if !OneOf(audit.EventType(v), audit.EventTypes) {
+				adminBadRequest(w, "unknown event type")
+				return
+			}
+			eventType = &v
+		}
+
+		var since, until *time.Time
+		for _, p := range []struct {
+			name string
+			dst  **time.Time
+		}{{"since", &since}, {"until", &until}} {
+			if v := query.Get(p.name); v != "" {
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					adminBadRequest(w, fmt.Sprintf("'%s' must be an RFC 3339 timestamp", p.name))
+					return
+				}
+				*p.dst = &t
+			}
+		}
+
+		limit, offset, err := PageParams(query, auditPageDefault, auditPageMax)
+		if err != nil {
+			adminBadRequest(w, err.Error())
+			return
+		}
+
+		// Ask for one extra row to find out whether there is another page
+		rows, err := s.DBPool.Query(context.Background(), `SELECT event_id, occurred_at, event_type, username, host(ip_address), user_agent, session_hash, outcome, detail, impersonated_by
+FROM Auth.FN_Query_Audit_Events($1, $2, $3::TIMESTAMPTZ, $4::TIMESTAMPTZ, $5::INT, $6::INT);`,
+			username, eventType, since, until, limit+1, offset)
+		if err != nil {
+			log.Printf("/api/admin/audit | %v\n", err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "failed to get audit events"
+}`)
+			return
+		}
+		defer rows.Close()
+
+		events := []AuditEvent{}
+		for rows.Next() {
+			var e AuditEvent
+			err = rows.Scan(&e.EventID, &e.OccurredAt, &e.EventType, &e.Username, &e.IPAddress, &e.UserAgent, &e.SessionHash, &e.Outcome, &e.Detail, &e.ImpersonatedBy)
+			if err != nil {
+				break
+			}
+			events = append(events, e)
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		if err != nil {
+			log.Printf("/api/admin/audit | %v\n", err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "failed to get audit events during query"
+}`)
+			return
+		}
+
+		nextOffset := "null"
+		if len(events) > limit {
+			events = events[:limit]
+			nextOffset = strconv.Itoa(offset + limit)
+		}
+
+		data, _ := json.Marshal(events)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{
+	"status": "success",
+	"message": "got audit events",
+	"data": %s,
+	"pagination": {
+		"limit": %d,
+		"offset": %d,
+		"next_offset": %s
+	}
+}`, data, limit, offset, nextOffset)
+	}
+}
@@ -4,27 +4,59 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/liamrlawrence/sigil-rest_api/internal/audit"
+	"github.com/liamrlawrence/sigil-rest_api/internal/dberr"
 	"github.com/liamrlawrence/sigil-rest_api/internal/logging"
 	"github.com/liamrlawrence/sigil-rest_api/internal/server"
+	"github.com/liamrlawrence/sigil-rest_api/internal/sessioncache"
+	"io"
 	"log"
 	"net/http"
+	"time"
 )
 
-func AuthTokenMiddleware(s *server.Server) func(next http.Handler) http.Handler {
+// AuthPolicy is how a route group authenticates its callers, applied with Authenticate in SetupEndpoints
+type AuthPolicy int
+
+const (
+	// AuthPublic routes need no credentials
+	AuthPublic AuthPolicy = iota
+	// AuthSession routes need a valid X-Grimoire-Token header or session cookie
+	AuthSession
+	// AuthSessionAllowExpired routes also accept an expired session, so that it can be refreshed
+	AuthSessionAllowExpired
+	// AuthAPIKey routes accept an API key in an Authorization: Bearer header as well as a session
+	AuthAPIKey
+)
+
+func Authenticate(s *server.Server, policy AuthPolicy) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
+		if policy == AuthPublic {
+			return next
+		}
+
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Skip authentication on these routes
-			switch r.URL.Path {
-			case "/api/auth/login":
-				next.ServeHTTP(w, r)
-				return
-			}
+			// An API key sent explicitly wins over a session cookie the browser attached on its own
+			sessionID, fromCookie := SessionToken(r)
+			apiKey, hasAPIKey := BearerToken(r)
+			if sessionID == "" || (fromCookie && hasAPIKey) {
+				if hasAPIKey {
+					if policy != AuthAPIKey {
+						w.Header().Set("Content-Type", "application/json; charset=utf-8")
+						w.WriteHeader(http.StatusForbidden)
+						fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "forbidden: this route requires a session, not an API key"
+}`)
+						return
+					}
+					AuthenticateAPIKey(s, apiKey, next).ServeHTTP(w, r)
+					return
+				}
 
-			// Authenticate
-			sessionID := r.Header.Get("X-Grimoire-Token")
-			if sessionID == "" {
-				w.WriteHeader(http.StatusBadRequest)
 				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.WriteHeader(http.StatusBadRequest)
 				fmt.Fprintf(w, `{
 	"status": "failed",
 	"message": "missing session id"
@@ -32,66 +64,60 @@ func AuthTokenMiddleware(s *server.Server) func(next http.Handler) http.Handler
 				return
 			}
 
-			row, err := s.DBPool.Query(context.Background(), "SELECT * FROM Auth.FN_Valid_Session($1::UUID);", sessionID)
-			if err != nil {
-				log.Fatalf("Failed to execute query: %v", err)
-			}
-			valid := row.Next()
-			row.Close()
-
-			if !valid {
-				if err := row.Err(); err != nil {
-					log.Printf("/api/auth/refresh | %v\n", err)
-
-					switch err.Error() {
-					case "ERROR: invalid session id (SQLSTATE P0001)":
-						w.WriteHeader(http.StatusBadRequest)
-						w.Header().Set("Content-Type", "application/json; charset=utf-8")
-						fmt.Fprint(w, `{
+			if fromCookie && !ValidCSRF(r) {
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, `{
 	"status": "failed",
-	"message": "invalid session id"
+	"message": "forbidden: missing or invalid csrf token"
 }`)
-						return
+				return
+			}
 
-					case "ERROR: session id is expired (SQLSTATE P0001)":
-						if r.URL.Path == "/api/auth/refresh" {
-							next.ServeHTTP(w, r)
-							return
-						}
-						w.WriteHeader(http.StatusBadRequest)
-						w.Header().Set("Content-Type", "application/json; charset=utf-8")
-						fmt.Fprint(w, `{
-	"status": "failed",
-	"message": "session id is expired"
-}`)
-						return
+			// Recently validated sessions skip the database, so last-seen is only recorded on a cache miss
+			if entry, ok := s.SessionCache.Get(sessionID); ok {
+				session := Session{ID: sessionID, Username: entry.Username, Role: entry.Role, FromCookie: fromCookie, ImpersonatedBy: entry.ImpersonatedBy}
+				serveSession(w, r, next, session)
+				return
+			}
 
-					case "ERROR: refresh token is expired (SQLSTATE P0001)":
-						w.WriteHeader(http.StatusBadRequest)
-						w.Header().Set("Content-Type", "application/json; charset=utf-8")
-						fmt.Fprint(w, `{
-	"status": "failed",
-	"message": "refresh token is expired"
-}`)
-						return
+			// Validate the session and record where it was last used from
+			generation := s.SessionCache.Generation()
+			session := Session{ID: sessionID, FromCookie: fromCookie}
+			var expiresAt time.Time
+			err := s.DBPool.QueryRow(context.Background(), "SELECT username, role, expires_at, COALESCE(impersonated_by, '') FROM Auth.FN_Valid_Session($1::UUID, $2::INET, $3);",
+				sessionID, ClientIP(r), r.UserAgent()).Scan(&session.Username, &session.Role, &expiresAt, &session.ImpersonatedBy)
+			if err != nil {
+				log.Printf("Authenticate | %v\n", err)
 
-					default:
-						w.WriteHeader(http.StatusBadRequest)
-						w.Header().Set("Content-Type", "application/json; charset=utf-8")
-						fmt.Fprint(w, `{
-	"status": "failed",
-	"message": "Unknown error"
-}`)
+				dbErr := dberr.From(err)
+				switch dbErr {
+				case dberr.ErrSessionExpired:
+					if policy == AuthSessionAllowExpired {
+						next.ServeHTTP(w, withSession(r, session))
 						return
 					}
+				case dberr.ErrNotFound, dberr.ErrMalformedID:
+					dbErr = dberr.ErrInvalidSession
 				}
-			} else {
-				next.ServeHTTP(w, r)
+				dbErr.WriteJSON(w)
+				return
 			}
+
+			s.SessionCache.Set(sessionID, sessioncache.Entry{Username: session.Username, Role: session.Role, ImpersonatedBy: session.ImpersonatedBy}, expiresAt, generation)
+			serveSession(w, r, next, session)
 		})
 	}
 }
 
+// serveSession passes the request on with the session attached, flagging every response to an impersonated session
+func serveSession(w http.ResponseWriter, r *http.Request, next http.Handler, session Session) {
+	if session.IsImpersonated() {
+		w.Header().Set(ImpersonatedByHeader, session.ImpersonatedBy)
+	}
+	next.ServeHTTP(w, withSession(r, session))
+}
+
 func HandlerRouteAuthRefresh(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		type RequestBody struct {
@@ -99,69 +125,114 @@ func HandlerRouteAuthRefresh(s *server.Server) func(w http.ResponseWriter, r *ht
 			RefreshToken string `json:"refresh_token"`
 		}
 
+		// Cookie clients send the refresh token in its cookie, so they may leave the body empty
 		var requestBody RequestBody
 		err := json.NewDecoder(r.Body).Decode(&requestBody)
-		if err != nil {
+		if err != nil && err != io.EOF {
 			http.Error(w, "Failed to read request body", http.StatusBadRequest)
 			return
 		}
 
 		// Authenticate
-		sessionID := r.Header.Get("X-Grimoire-Token")
+		session, _ := SessionFromContext(r.Context())
+		sessionID := session.ID
 		if sessionID == "" {
 			http.Error(w, "Missing session ID", http.StatusBadRequest)
 			return
 		}
 		logging.APIEndpoint(r, "POST", fmt.Sprintf("/api/auth/refresh"))
 		refreshToken := requestBody.RefreshToken
+		if refreshToken == "" && session.FromCookie {
+			if cookie, err := r.Cookie(RefreshCookieName); err == nil {
+				refreshToken = cookie.Value
+			}
+		}
 
-		row, err := s.DBPool.Query(context.Background(), "SELECT Auth.FN_Refresh_Session($1::UUID, $2::UUID);", sessionID, refreshToken)
+		// Refresh tokens are single use and belong to a family that starts at login. Presenting one that
+		// was already rotated means it was copied, so the function revokes the whole family and its
+		// sessions. It reports the reuse instead of raising it, which would roll back the revocation.
+		var newRefreshToken string
+		var reuseDetected bool
+		var username string
+		err = s.DBPool.QueryRow(context.Background(), "SELECT COALESCE(refresh_token::TEXT, ''), reuse_detected, username FROM Auth.FN_Refresh_Session($1::UUID, $2::UUID);",
+			sessionID, refreshToken).Scan(&newRefreshToken, &reuseDetected, &username)
 		if err != nil {
-			log.Fatalf("database query failed: %v", err)
+			log.Printf("/api/auth/refresh | %v\n", err)
+			dbErr := dberr.From(err)
+			if dbErr == dberr.ErrMalformedID {
+				dbErr = dberr.ErrInvalidRefreshToken
+			}
+			dbErr.WriteJSON(w)
+			return
 		}
-		defer row.Close()
 
-		if row.Next() {
-			var newRefreshToken string
-			err = row.Scan(&newRefreshToken)
-			if err != nil {
-				log.Fatalf("Failed to scan row: %v", err)
+		if reuseDetected {
+			log.Printf("SECURITY /api/auth/refresh | refresh token reuse detected for %s from %s, revoked the token family\n", username, ClientIP(r))
+			s.SessionCache.NotifyUser(context.Background(), s.DBPool, username)
+			RecordAuditEvent(s, r, audit.EventRefreshReuse, username, sessionID, audit.OutcomeFailure, "revoked the token family")
+			if session.FromCookie {
+				ClearSessionCookies(w)
 			}
+			dberr.ErrRefreshTokenReused.WriteJSON(w)
+			return
+		}
+		s.SessionCache.Notify(context.Background(), s.DBPool, sessionID)
+		RecordAuditEvent(s, r, audit.EventRefresh, username, sessionID, audit.OutcomeSuccess, "")
 
-			w.WriteHeader(http.StatusOK)
+		if session.FromCookie {
+			SetRefreshCookie(w, sessionID, newRefreshToken)
 			w.Header().Set("Content-Type", "application/json; charset=utf-8")
-			fmt.Fprintf(w, `{
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, `{
+	"status": "success",
+	"message": "session refreshed"
+}`)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{
 	"status": "success",
 	"message": "session refreshed",
 	"data": {
 		"refresh_token": "%v"
 	}
 }`,
-				newRefreshToken)
-		}
+			newRefreshToken)
+	}
+}
 
-		if err := row.Err(); err != nil {
-			log.Printf("/api/auth/login | %v\n", err)
-			switch err.Error() {
-			case "ERROR: invalid refresh token (SQLSTATE P0001)":
-				w.WriteHeader(http.StatusBadRequest)
-				w.Header().Set("Content-Type", "application/json; charset=utf-8")
-				fmt.Fprint(w, `{
-	"status": "failed",
-	"message": "invalid refresh token"
-}`)
-				return
+func HandlerRouteAuthLogOut(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logging.APIEndpoint(r, "POST", "/api/auth/logout")
 
-			default:
-				w.WriteHeader(http.StatusBadRequest)
-				w.Header().Set("Content-Type", "application/json; charset=utf-8")
-				fmt.Fprint(w, `{
+		// Revoke the session and its refresh token
+		session, _ := SessionFromContext(r.Context())
+		sessionID := session.ID
+		_, err := s.DBPool.Exec(context.Background(), "CALL Auth.SP_User_LogOut($1::UUID);", sessionID)
+		s.SessionCache.Notify(context.Background(), s.DBPool, sessionID)
+		if session.FromCookie {
+			ClearSessionCookies(w)
+		}
+		if err != nil {
+			log.Printf("/api/auth/logout | %v\n", err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{
 	"status": "failed",
 	"message": "Unknown error"
 }`)
-				return
-			}
+			return
 		}
+		RecordAuditEvent(s, r, audit.EventLogout, session.Username, sessionID, audit.OutcomeSuccess, "")
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{
+	"status": "success",
+	"message": "signed out"
+}`)
 	}
 }
 
@@ -170,6 +241,9 @@ func HandlerRouteAuthLogIn(s *server.Server) func(w http.ResponseWriter, r *http
 		type RequestBody struct {
 			Username string `json:"username"`
 			Password string `json:"password"`
+
+			// UseCookies keeps the session in HttpOnly cookies instead of returning it in the response
+			UseCookies bool `json:"use_cookies"`
 		}
 
 		var requestBody RequestBody
@@ -183,51 +257,149 @@ func HandlerRouteAuthLogIn(s *server.Server) func(w http.ResponseWriter, r *http
 		password := requestBody.Password
 		logging.APIEndpoint(r, "POST", fmt.Sprintf("/api/auth/login - %s", username))
 
-		row, err := s.DBPool.Query(context.Background(), "SELECT session_id, refresh_token FROM Auth.FN_User_LogIn($1, $2);", username, password)
-		if err != nil {
-			log.Fatalf("database query failed: %v", err)
+		ip := ClientIP(r)
+		attempt := BeginLoginAttempt(s, w, username, ip)
+		if attempt == nil {
+			return
 		}
-		defer row.Close()
+		defer attempt.Close()
 
-		if row.Next() {
-			var sessionID string
-			var refreshToken string
-			err = row.Scan(&sessionID, &refreshToken)
-			if err != nil {
-				log.Fatalf("Failed to scan row: %v", err)
+		// Users enrolled in TOTP get a challenge token instead of a session, see HandlerRouteAuthLogInTOTP
+		var sessionID string
+		var refreshToken string
+		var totpChallenge string
+		err = attempt.Run(func(tx pgx.Tx) error {
+			return tx.QueryRow(context.Background(), `SELECT COALESCE(session_id::TEXT, ''), COALESCE(refresh_token::TEXT, ''), COALESCE(totp_challenge::TEXT, '')
+FROM Auth.FN_User_LogIn($1, $2, $3::INET, $4, $5::INTERVAL);`,
+				username, password, ip, r.UserAgent(), totpChallengeTTL).Scan(&sessionID, &refreshToken, &totpChallenge)
+		})
+		if err != nil {
+			log.Printf("/api/auth/login | %v\n", err)
+			dbErr := dberr.From(err)
+			if dbErr == dberr.ErrIncorrectLogin {
+				attempt.Fail(r)
 			}
+			RecordAuditEvent(s, r, audit.EventLoginFailure, username, "", audit.OutcomeFailure, dbErr.Code)
+			dbErr.WriteJSON(w)
+			return
+		}
+		if totpChallenge != "" {
+			err = attempt.Continue()
+		} else {
+			err = attempt.Succeed()
+		}
+		if err != nil {
+			log.Printf("/api/auth/login | %v\n", err)
+			dberr.From(err).WriteJSON(w)
+			return
+		}
 
-			w.WriteHeader(http.StatusOK)
+		if totpChallenge != "" {
+			RecordAuditEvent(s, r, audit.EventLoginSuccess, username, "", audit.OutcomeSuccess, "password accepted, totp required")
 			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
 			fmt.Fprintf(w, `{
 	"status": "success",
-	"message": "signed in",
+	"message": "totp required",
+	"data": {
+		"challenge_token": "%v",
+		"expires_in": %d
+	}
+}`,
+				totpChallenge, int(totpChallengeTTL.Seconds()))
+			return
+		}
+		RecordAuditEvent(s, r, audit.EventLoginSuccess, username, sessionID, audit.OutcomeSuccess, "password")
+
+		WriteSignedIn(w, r, http.StatusOK, "signed in", sessionID, refreshToken, requestBody.UseCookies)
+	}
+}
+
+// WriteSignedIn responds with a new session, either in the response body or, when useCookies is set,
+// in HttpOnly cookies with only the CSRF token in the body
+func WriteSignedIn(w http.ResponseWriter, r *http.Request, status int, message string, sessionID string, refreshToken string, useCookies bool) {
+	if useCookies {
+		csrfToken, err := SetSessionCookies(w, sessionID, refreshToken)
+		if err != nil {
+			log.Printf("%s | %v\n", r.URL.Path, err)
+			dberr.ErrUnknown.WriteJSON(w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{
+	"status": "success",
+	"message": "%s",
+	"data": {
+		"csrf_token": "%v"
+	}
+}`,
+			message, csrfToken)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{
+	"status": "success",
+	"message": "%s",
 	"data": {
 		"session_id": "%v",
 		"refresh_token": "%v"
 	}
 }`,
-				sessionID, refreshToken)
+		message, sessionID, refreshToken)
+}
+
+func HandlerRouteAuthSignUp(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type RequestBody struct {
+			Username        string `json:"username"`
+			Email           string `json:"email"`
+			Password        string `json:"password"`
+			PasswordConfirm string `json:"password_confirm"`
+			UseCookies      bool   `json:"use_cookies"`
 		}
 
-		if err := row.Err(); err != nil {
-			log.Printf("/api/auth/login | %v\n", err)
-			switch err.Error() {
-			case "ERROR: incorrect username and password (SQLSTATE P0001)":
-				w.WriteHeader(http.StatusBadRequest)
+		var requestBody RequestBody
+		err := json.NewDecoder(r.Body).Decode(&requestBody)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		username := requestBody.Username
+		email := requestBody.Email
+		logging.APIEndpoint(r, "POST", fmt.Sprintf("/api/auth/sign-up - %s", username))
+
+		// Validate the new account before touching the database
+		for _, err := range []error{
+			ValidateUsername(username),
+			ValidateEmail(email),
+			ValidatePassword(requestBody.Password, requestBody.PasswordConfirm),
+		} {
+			if err != nil {
 				w.Header().Set("Content-Type", "application/json; charset=utf-8")
-				fmt.Fprint(w, `{
-	"status": "failed",
-	"message": "incorrect username or password"
-}`)
-			default:
 				w.WriteHeader(http.StatusBadRequest)
-				w.Header().Set("Content-Type", "application/json; charset=utf-8")
-				fmt.Fprint(w, `{
+				fmt.Fprintf(w, `{
 	"status": "failed",
-	"message": "Unknown error"
-}`)
+	"message": "%v"
+}`, err)
+				return
 			}
 		}
+
+		var sessionID string
+		var refreshToken string
+		err = s.DBPool.QueryRow(context.Background(), "SELECT session_id, refresh_token FROM Auth.FN_User_SignUp($1, $2, $3, $4::INET, $5);",
+			username, email, requestBody.Password, ClientIP(r), r.UserAgent()).Scan(&sessionID, &refreshToken)
+		if err != nil {
+			log.Printf("/api/auth/sign-up | %v\n", err)
+			dberr.From(err).WriteJSON(w)
+			return
+		}
+
+		WriteSignedIn(w, r, http.StatusCreated, "signed up", sessionID, refreshToken, requestBody.UseCookies)
 	}
 }
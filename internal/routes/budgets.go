@@ -0,0 +1,284 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/liamrlawrence/sigil-rest_api/internal/dberr"
+	"github.com/liamrlawrence/sigil-rest_api/internal/llm"
+	"github.com/liamrlawrence/sigil-rest_api/internal/logging"
+	"github.com/liamrlawrence/sigil-rest_api/internal/models"
+	"github.com/liamrlawrence/sigil-rest_api/internal/server"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Budgets cap the dollars spent on AI calls over a day or a calendar month, for a user, for a billing
+// name, or for the whole team. Every budget that applies to a call is checked before the model is called,
+// against what has been spent so far in the period plus the most the call could cost.
+//
+// The check isn't a reservation, so calls made at the same time can together go over a budget by up to
+// the cost of one call each.
+
+const (
+	BudgetScopeUser = "user"
+	BudgetScopeName = "name"
+	BudgetScopeTeam = "team"
+
+	BudgetPeriodDaily   = "daily"
+	BudgetPeriodMonthly = "monthly"
+)
+
+var (
+	budgetScopes  = []string{BudgetScopeUser, BudgetScopeName, BudgetScopeTeam}
+	budgetPeriods = []string{BudgetPeriodDaily, BudgetPeriodMonthly}
+)
+
+// Budget is a limit in dollars, with what has been spent against it in the current period.
+// Subject is the username or billing name, and is empty for the team.
+type Budget struct {
+	Scope     string    `json:"scope"`
+	Subject   string    `json:"subject"`
+	Period    string    `json:"period"`
+	Limit     float64   `json:"limit"`
+	Spent     float64   `json:"spent"`
+	Remaining float64   `json:"remaining"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+func scanBudget(row pgx.Row) (Budget, error) {
+	var b Budget
+	err := row.Scan(&b.Scope, &b.Subject, &b.Period, &b.Limit, &b.Spent, &b.ResetsAt)
+	b.Remaining = math.Max(b.Limit-b.Spent, 0)
+	return b, err
+}
+
+func scanBudgets(rows pgx.Rows) ([]Budget, error) {
+	defer rows.Close()
+
+	budgets := []Budget{}
+	for rows.Next() {
+		b, err := scanBudget(rows)
+		if err != nil {
+			return nil, err
+		}
+		budgets = append(budgets, b)
+	}
+	return budgets, rows.Err()
+}
+
+// EstimateCost is the most the request could cost in dollars, with the reply running to max_tokens, or
+// to the end of the context when the request leaves it open. The price comes from AI.Model_Prices, the
+// same as the cost of the bill, and a model without a price there is an ErrModelNotPriced.
+func EstimateCost(s *server.Server, model models.Model, req llm.Request) (float64, error) {
+	var promptTokens int
+	for _, m := range req.Messages {
+		promptTokens += llm.EstimateTokens(m.Content)
+	}
+	completionTokens := req.MaxTokens
+	if completionTokens == 0 {
+		completionTokens = model.ContextLimit - promptTokens
+	}
+
+	var inputPrice, outputPrice float64
+	err := s.DBPool.QueryRow(context.Background(), "SELECT input_price, output_price FROM AI.FN_Current_Model_Price($1);",
+		model.UpstreamID).Scan(&inputPrice, &outputPrice)
+	if dberr.From(err) == dberr.ErrNotFound {
+		err = dberr.ErrModelNotPriced
+	}
+	if err != nil {
+		return 0, fmt.Errorf("estimate cost of %s: %w", model.UpstreamID, err)
+	}
+
+	return (float64(promptTokens)*inputPrice + float64(completionTokens)*outputPrice) / 1e6, nil
+}
+
+// CheckBudget writes a 402 and returns false when the request could take any budget of the caller,
+// their billing name or the team past its limit. When a budget applies but the model has no price the
+// request is refused too, rather than let through unchecked.
+func CheckBudget(s *server.Server, w http.ResponseWriter, session Session, name string, model models.Model, req llm.Request) bool {
+	rows, err := s.DBPool.Query(context.Background(), `SELECT scope, COALESCE(subject, ''), period, limit_amount, spent, resets_at
+FROM AI.FN_Applicable_Budgets($1, $2);`, session.Username, name)
+	if err != nil {
+		log.Printf("CheckBudget | %v\n", err)
+		dberr.From(err).WriteJSON(w)
+		return false
+	}
+	budgets, err := scanBudgets(rows)
+	if err != nil {
+		log.Printf("CheckBudget | %v\n", err)
+		dberr.From(err).WriteJSON(w)
+		return false
+	}
+	if len(budgets) == 0 {
+		return true
+	}
+
+	estimate, err := EstimateCost(s, model, req)
+	if err != nil {
+		log.Printf("CheckBudget | %v\n", err)
+		dberr.From(err).WriteJSON(w)
+		return false
+	}
+
+	for _, b := range budgets {
+		if b.Spent+estimate <= b.Limit {
+			continue
+		}
+
+		data, _ := json.Marshal(b)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if wait := time.Until(b.ResetsAt); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		}
+		w.WriteHeader(http.StatusPaymentRequired)
+		fmt.Fprintf(w, `{
+	"status": "failed",
+	"message": "the %s %s budget has $%.4f left, and this request could cost up to $%.4f",
+	"estimate": %v,
+	"budget": %s
+}`, b.Period, b.Scope, b.Remaining, estimate, estimate, data)
+		return false
+	}
+	return true
+}
+
+// budgetFields checks the scope, subject and period given for a budget, writing a 400 when they don't make one
+func budgetFields(w http.ResponseWriter, scope string, subject string, period string) bool {
+	switch {
+	case !OneOf(scope, budgetScopes):
+		adminBadRequest(w, fmt.Sprintf("unknown scope '%s', expected one of: %s", scope, strings.Join(budgetScopes, ", ")))
+	case !OneOf(period, budgetPeriods):
+		adminBadRequest(w, fmt.Sprintf("unknown period '%s', expected one of: %s", period, strings.Join(budgetPeriods, ", ")))
+	case scope == BudgetScopeTeam && subject != "":
+		adminBadRequest(w, "a team budget doesn't take a 'subject'")
+	case scope != BudgetScopeTeam && subject == "":
+		adminBadRequest(w, fmt.Sprintf("a %s budget requires a 'subject'", scope))
+	default:
+		return true
+	}
+	return false
+}
+
+// HandlerRouteAdminBudgets lists every budget with its spend in the current period, optionally for one scope
+func HandlerRouteAdminBudgets(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logging.APIEndpoint(r, "GET", "/api/admin/ai/budgets")
+
+		rows, err := s.DBPool.Query(context.Background(), `SELECT scope, COALESCE(subject, ''), period, limit_amount, spent, resets_at
+FROM AI.FN_List_Budgets(NULLIF($1, ''));`, r.URL.Query().Get("scope"))
+		if err != nil {
+			log.Printf("/api/admin/ai/budgets | %v\n", err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "failed to get budgets"
+}`)
+			return
+		}
+		budgets, err := scanBudgets(rows)
+		if err != nil {
+			log.Printf("/api/admin/ai/budgets | %v\n", err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "failed to get budgets during query"
+}`)
+			return
+		}
+
+		data, _ := json.Marshal(budgets)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{
+	"status": "success",
+	"message": "got budgets",
+	"data": %s
+}`, data)
+	}
+}
+
+// HandlerRouteAdminSetBudget creates a budget, or changes the limit of the one with the same scope, subject and period
+func HandlerRouteAdminSetBudget(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type RequestBody struct {
+			Scope   string   `json:"scope"`
+			Subject string   `json:"subject"`
+			Period  string   `json:"period"`
+			Limit   *float64 `json:"limit"`
+		}
+
+		var requestBody RequestBody
+		err := json.NewDecoder(r.Body).Decode(&requestBody)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		logging.APIEndpoint(r, "PUT", fmt.Sprintf("/api/admin/ai/budgets - %s %s %s", requestBody.Scope, requestBody.Subject, requestBody.Period))
+
+		if !budgetFields(w, requestBody.Scope, requestBody.Subject, requestBody.Period) {
+			return
+		}
+		if requestBody.Limit == nil || *requestBody.Limit < 0 {
+			adminBadRequest(w, "request body requires a 'limit' in dollars that isn't negative")
+			return
+		}
+
+		budget, err := scanBudget(s.DBPool.QueryRow(context.Background(), `SELECT scope, COALESCE(subject, ''), period, limit_amount, spent, resets_at
+FROM AI.FN_Set_Budget($1, NULLIF($2, ''), $3, $4);`,
+			requestBody.Scope, requestBody.Subject, requestBody.Period, *requestBody.Limit))
+		if err != nil {
+			log.Printf("/api/admin/ai/budgets | %v\n", err)
+			dberr.From(err).WriteJSON(w)
+			return
+		}
+
+		data, _ := json.Marshal(budget)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{
+	"status": "success",
+	"message": "budget set",
+	"data": %s
+}`, data)
+	}
+}
+
+// HandlerRouteAdminDeleteBudget removes the budget given by the scope, subject and period in the query
+func HandlerRouteAdminDeleteBudget(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		scope, subject, period := query.Get("scope"), query.Get("subject"), query.Get("period")
+		logging.APIEndpoint(r, "DELETE", fmt.Sprintf("/api/admin/ai/budgets - %s %s %s", scope, subject, period))
+
+		if !budgetFields(w, scope, subject, period) {
+			return
+		}
+
+		_, err := s.DBPool.Exec(context.Background(), "CALL AI.SP_Delete_Budget($1, NULLIF($2, ''), $3);", scope, subject, period)
+		if err != nil {
+			log.Printf("/api/admin/ai/budgets | %v\n", err)
+			dbErr := dberr.From(err)
+			if dbErr == dberr.ErrNotFound {
+				dbErr = dberr.ErrBudgetNotFound
+			}
+			dbErr.WriteJSON(w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{
+	"status": "success",
+	"message": "budget deleted"
+}`)
+	}
+}
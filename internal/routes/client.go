@@ -0,0 +1,71 @@
+package routes
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	trustedProxies     []*net.IPNet
+	trustedProxiesOnce sync.Once
+)
+
+// TrustedProxies reads AUTH_TRUSTED_PROXIES, a comma separated list of CIDRs, the first time it is called.
+// It defaults to the docker network the nginx reverse proxy runs on.
+func TrustedProxies() []*net.IPNet {
+	trustedProxiesOnce.Do(func() {
+		cidrs := os.Getenv("AUTH_TRUSTED_PROXIES")
+		if cidrs == "" {
+			cidrs = "172.30.0.0/16"
+		}
+		for _, cidr := range strings.Split(cidrs, ",") {
+			_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				log.Printf("AUTH_TRUSTED_PROXIES | skipping %q: %v\n", cidr, err)
+				continue
+			}
+			trustedProxies = append(trustedProxies, network)
+		}
+	})
+	return trustedProxies
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range TrustedProxies() {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the caller. The X-Forwarded-For set by the nginx reverse proxy is only believed
+// when the request came from a trusted proxy, since anyone else can send whatever they like in it.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if peer := net.ParseIP(host); peer == nil || !isTrustedProxy(peer) {
+		return host
+	}
+
+	// Each proxy appends the address it got the request from, so the first address from the right that
+	// isn't a trusted proxy is the caller, and anything left of it could have been sent by the caller.
+	// X-Real-IP isn't used, since nginx passes on whatever the caller sent in it unless told to overwrite it.
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		if !isTrustedProxy(ip) {
+			return ip.String()
+		}
+	}
+	return host
+}
@@ -0,0 +1,46 @@
+package routes
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// The tests rely on the default AUTH_TRUSTED_PROXIES of 172.30.0.0/16
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		xRealIP       string
+		xForwardedFor string
+		want          string
+	}{
+		{"untrusted peer", "203.0.113.7:5000", "", "", "203.0.113.7"},
+		{"untrusted peer ignores forwarded for", "203.0.113.7:5000", "", "198.51.100.1", "203.0.113.7"},
+		{"untrusted peer ignores real ip", "203.0.113.7:5000", "198.51.100.1", "", "203.0.113.7"},
+		{"trusted peer", "172.30.0.2:5000", "", "198.51.100.1", "198.51.100.1"},
+		{"trusted peer without forwarded for", "172.30.0.2:5000", "", "", "172.30.0.2"},
+		{"trusted peer ignores real ip", "172.30.0.2:5000", "10.9.9.9", "198.51.100.1", "198.51.100.1"},
+		{"spoofed hops left of the caller", "172.30.0.2:5000", "", "10.9.9.9, 198.51.100.1", "198.51.100.1"},
+		{"chain of trusted proxies", "172.30.0.2:5000", "", "198.51.100.1, 172.30.0.9", "198.51.100.1"},
+		{"garbage hop", "172.30.0.2:5000", "", "198.51.100.1, not-an-ip", "172.30.0.2"},
+		{"ipv6 caller", "172.30.0.2:5000", "", "2001:db8::1", "2001:db8::1"},
+		{"remote addr without port", "203.0.113.7", "", "", "203.0.113.7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/auth/login", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.xRealIP != "" {
+				r.Header.Set("X-Real-IP", tt.xRealIP)
+			}
+			if tt.xForwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", tt.xForwardedFor)
+			}
+
+			if got := ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+)
+
+type contextKey string
+
+const sessionContextKey contextKey = "session"
+
+// Session is the authenticated caller, attached to the request context by Authenticate.
+// Callers using an API key have an APIKeyID and Scopes instead of a session ID.
+type Session struct {
+	ID       string
+	APIKeyID string
+	Username string
+	Role     string
+	Scopes   []string
+
+	// FromCookie is set when the session ID came from the session cookie rather than the header
+	FromCookie bool
+	// ImpersonatedBy is the admin acting as Username, for sessions opened with HandlerRouteAdminImpersonate
+	ImpersonatedBy string
+}
+
+func (session Session) IsImpersonated() bool {
+	return session.ImpersonatedBy != ""
+}
+
+func (session Session) IsAPIKey() bool {
+	return session.APIKeyID != ""
+}
+
+func withSession(r *http.Request, session Session) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionContextKey, session))
+}
+
+func SessionFromContext(ctx context.Context) (Session, bool) {
+	session, ok := ctx.Value(sessionContextKey).(Session)
+	return session, ok
+}
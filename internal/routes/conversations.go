@@ -0,0 +1,380 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/liamrlawrence/sigil-rest_api/internal/dberr"
+	"github.com/liamrlawrence/sigil-rest_api/internal/llm"
+	"github.com/liamrlawrence/sigil-rest_api/internal/logging"
+	"github.com/liamrlawrence/sigil-rest_api/internal/server"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Conversations belong to the user behind the session or API key, and keep the model and billing name
+// they were created with. Each assistant message records its token usage and the bill it was charged to.
+
+type ConversationMessage struct {
+	MessageID        int64     `json:"message_id"`
+	Role             string    `json:"role"`
+	Content          string    `json:"content"`
+	CreatedAt        time.Time `json:"created_at"`
+	PromptTokens     *int      `json:"prompt_tokens"`
+	CompletionTokens *int      `json:"completion_tokens"`
+	BillID           *int64    `json:"bill_id"`
+}
+
+func conversationMessages(s *server.Server, username string, conversationID string) ([]ConversationMessage, error) {
+	rows, err := s.DBPool.Query(context.Background(), `SELECT message_id, role, content, created_at, prompt_tokens, completion_tokens, bill_id
+FROM AI.FN_List_Messages($1, $2::UUID);`, username, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []ConversationMessage{}
+	for rows.Next() {
+		var m ConversationMessage
+		err = rows.Scan(&m.MessageID, &m.Role, &m.Content, &m.CreatedAt, &m.PromptTokens, &m.CompletionTokens, &m.BillID)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+func conversationNotFound(w http.ResponseWriter, err error) {
+	dbErr := dberr.From(err)
+	if dbErr == dberr.ErrNotFound || dbErr == dberr.ErrMalformedID {
+		dbErr = dberr.ErrConversationNotFound
+	}
+	dbErr.WriteJSON(w)
+}
+
+func HandlerRouteAICreateConversation(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type RequestBody struct {
+			Model        string `json:"model"`
+			Name         string `json:"name"`
+			Title        string `json:"title"`
+			SystemPrompt string `json:"system_prompt"`
+		}
+
+		var requestBody RequestBody
+		err := json.NewDecoder(r.Body).Decode(&requestBody)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		logging.APIEndpoint(r, "POST", fmt.Sprintf("/api/ai/conversations - %s", requestBody.Model))
+
+		if requestBody.Model == "" || requestBody.Name == "" {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "request body requires fields 'model' and 'name'"
+}`)
+			return
+		}
+
+		session, _ := SessionFromContext(r.Context())
+		model, ok := s.Models.Get(requestBody.Model)
+		if !ok || !model.Allows(session.Role) {
+			writeUnknownModel(w, requestBody.Model)
+			return
+		}
+
+		var conversationID string
+		err = s.DBPool.QueryRow(context.Background(), "SELECT AI.FN_Create_Conversation($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''))::TEXT;",
+			session.Username, model.Alias, requestBody.Name, requestBody.Title, requestBody.SystemPrompt).Scan(&conversationID)
+		if err != nil {
+			log.Printf("/api/ai/conversations | %v\n", err)
+			dberr.From(err).WriteJSON(w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{
+	"status": "success",
+	"message": "conversation created",
+	"data": {
+		"conversation_id": "%v"
+	}
+}`,
+			conversationID)
+	}
+}
+
+func HandlerRouteAIConversations(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	type Conversation struct {
+		ConversationID string    `json:"conversation_id"`
+		Title          *string   `json:"title"`
+		Model          string    `json:"model"`
+		Name           string    `json:"name"`
+		MessageCount   int       `json:"message_count"`
+		CreatedAt      time.Time `json:"created_at"`
+		UpdatedAt      time.Time `json:"updated_at"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logging.APIEndpoint(r, "GET", "/api/ai/conversations")
+
+		session, _ := SessionFromContext(r.Context())
+		rows, err := s.DBPool.Query(context.Background(), `SELECT conversation_id::TEXT, title, model, name, message_count, created_at, updated_at
+FROM AI.FN_List_Conversations($1);`, session.Username)
+		if err != nil {
+			log.Printf("/api/ai/conversations | %v\n", err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "failed to get conversations"
+}`)
+			return
+		}
+		defer rows.Close()
+
+		conversations := []Conversation{}
+		for rows.Next() {
+			var c Conversation
+			err = rows.Scan(&c.ConversationID, &c.Title, &c.Model, &c.Name, &c.MessageCount, &c.CreatedAt, &c.UpdatedAt)
+			if err != nil {
+				break
+			}
+			conversations = append(conversations, c)
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		if err != nil {
+			log.Printf("/api/ai/conversations | %v\n", err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "failed to get conversations during query"
+}`)
+			return
+		}
+
+		data, _ := json.Marshal(conversations)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{
+	"status": "success",
+	"message": "got conversations",
+	"data": %s
+}`, data)
+	}
+}
+
+func HandlerRouteAIConversation(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	type Conversation struct {
+		ConversationID string                `json:"conversation_id"`
+		Title          *string               `json:"title"`
+		Model          string                `json:"model"`
+		Name           string                `json:"name"`
+		SystemPrompt   *string               `json:"system_prompt"`
+		CreatedAt      time.Time             `json:"created_at"`
+		Messages       []ConversationMessage `json:"messages"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		conversationID := chi.URLParam(r, "conversationID")
+		logging.APIEndpoint(r, "GET", fmt.Sprintf("/api/ai/conversations/%s", conversationID))
+
+		session, _ := SessionFromContext(r.Context())
+		c := Conversation{ConversationID: conversationID}
+		err := s.DBPool.QueryRow(context.Background(), "SELECT title, model, name, system_prompt, created_at FROM AI.FN_Get_Conversation($1, $2::UUID);",
+			session.Username, conversationID).Scan(&c.Title, &c.Model, &c.Name, &c.SystemPrompt, &c.CreatedAt)
+		if err == nil {
+			c.Messages, err = conversationMessages(s, session.Username, conversationID)
+		}
+		if err != nil {
+			log.Printf("/api/ai/conversations | %v\n", err)
+			conversationNotFound(w, err)
+			return
+		}
+
+		data, _ := json.Marshal(c)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{
+	"status": "success",
+	"message": "got conversation",
+	"data": %s
+}`, data)
+	}
+}
+
+func HandlerRouteAIDeleteConversation(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conversationID := chi.URLParam(r, "conversationID")
+		logging.APIEndpoint(r, "DELETE", fmt.Sprintf("/api/ai/conversations/%s", conversationID))
+
+		// The bills of the conversation are kept, only their link to its messages goes away
+		session, _ := SessionFromContext(r.Context())
+		_, err := s.DBPool.Exec(context.Background(), "CALL AI.SP_Delete_Conversation($1, $2::UUID);", session.Username, conversationID)
+		if err != nil {
+			log.Printf("/api/ai/conversations | %v\n", err)
+			conversationNotFound(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{
+	"status": "success",
+	"message": "conversation deleted"
+}`)
+	}
+}
+
+// HandlerRouteAIConversationMessage sends a user message to the model along with the history of the conversation,
+// dropping the oldest messages when it no longer fits in the context, and stores the message and the reply
+func HandlerRouteAIConversationMessage(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type RequestBody struct {
+			Message     string   `json:"message"`
+			Temperature *float64 `json:"temperature"`
+			MaxTokens   *int     `json:"max_tokens"`
+			Stream      bool     `json:"stream"`
+		}
+
+		var requestBody RequestBody
+		err := json.NewDecoder(r.Body).Decode(&requestBody)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		conversationID := chi.URLParam(r, "conversationID")
+		logging.APIEndpoint(r, "POST", fmt.Sprintf("/api/ai/conversations/%s/messages", conversationID))
+
+		if requestBody.Message == "" {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "request body requires field 'message'"
+}`)
+			return
+		}
+
+		session, _ := SessionFromContext(r.Context())
+		var alias, name, systemPrompt string
+		var history []ConversationMessage
+		err = s.DBPool.QueryRow(context.Background(), "SELECT model, name, COALESCE(system_prompt, '') FROM AI.FN_Get_Conversation($1, $2::UUID);",
+			session.Username, conversationID).Scan(&alias, &name, &systemPrompt)
+		if err == nil {
+			history, err = conversationMessages(s, session.Username, conversationID)
+		}
+		if err != nil {
+			log.Printf("/api/ai/conversations/messages | %v\n", err)
+			conversationNotFound(w, err)
+			return
+		}
+
+		// The role of the caller may have changed, or the model been removed, since the conversation started
+		model, ok := s.Models.Get(alias)
+		if !ok || !model.Allows(session.Role) {
+			writeUnknownModel(w, alias)
+			return
+		}
+
+		provider, ok := ChatProvider(s, w, model)
+		if !ok {
+			return
+		}
+
+		messages := make([]llm.Message, 0, len(history)+2)
+		if systemPrompt != "" {
+			messages = append(messages, llm.Message{Role: "system", Content: systemPrompt})
+		}
+		for _, m := range history {
+			messages = append(messages, llm.Message{Role: m.Role, Content: m.Content})
+		}
+		messages = append(messages, llm.Message{Role: "user", Content: requestBody.Message})
+
+		req, ok := ChatParameters(model, messages, requestBody.Temperature, requestBody.MaxTokens)
+		if !ok {
+			writeChatParametersInvalid(w, model)
+			return
+		}
+
+		if !CheckBudget(s, w, session, name, model, req) {
+			return
+		}
+
+		// Stores the exchange once the reply is complete, or as far as it got when it was cut off
+		appendExchange := func(res llm.Response) (int64, Bill, error) {
+			bill, err := InsertGPTBill(s, session, name, model.UpstreamID, res.Usage)
+			if err != nil {
+				log.Printf("/api/ai/conversations/messages | %v\n", err)
+			}
+
+			var messageID int64
+			err = s.DBPool.QueryRow(context.Background(), "SELECT AI.FN_Append_Exchange($1, $2::UUID, $3, $4, $5, $6, NULLIF($7, 0));",
+				session.Username, conversationID, requestBody.Message, res.Content, res.Usage.PromptTokens, res.Usage.CompletionTokens, bill.ID).Scan(&messageID)
+			return messageID, bill, err
+		}
+
+		if WantsStream(r, requestBody.Stream) {
+			StreamChat(w, r, provider, req, func(res llm.Response) any {
+				var messageID any
+				id, bill, err := appendExchange(res)
+				if err != nil {
+					log.Printf("/api/ai/conversations/messages | %v\n", err)
+				} else {
+					messageID = id
+				}
+				return map[string]any{"message_id": messageID, "usage": BilledUsage{res.Usage, bill.Cost}, "model": model.Alias}
+			})
+			return
+		}
+
+		res, err := provider.Chat(r.Context(), req)
+		if err != nil {
+			log.Printf("/api/ai/conversations/messages | %v\n", err)
+			writeUpstreamError(w, err)
+			return
+		}
+
+		// The reply has been paid for by now, so it is still returned when it can't be stored, without a message ID
+		var messageID *int64
+		id, bill, err := appendExchange(res)
+		if err != nil {
+			log.Printf("/api/ai/conversations/messages | %v\n", err)
+		} else {
+			messageID = &id
+		}
+
+		messageIDData, _ := json.Marshal(messageID)
+		data, _ := json.Marshal(res.Content)
+		cost, _ := json.Marshal(bill.Cost)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{
+	"status": "success",
+	"message": "got reply",
+	"data": {
+		"message_id": %s,
+		"content": %s,
+		"model": "%v",
+		"usage": {
+			"prompt_tokens": %d,
+			"completion_tokens": %d,
+			"cost": %s
+		}
+	}
+}`,
+			messageIDData, data, model.Alias, res.Usage.PromptTokens, res.Usage.CompletionTokens, cost)
+	}
+}
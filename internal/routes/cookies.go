@@ -0,0 +1,102 @@
+package routes
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Browser clients can opt in to keeping their session in HttpOnly cookies instead of script-readable
+// storage. Requests authenticated by the session cookie must echo the CSRF cookie in the X-CSRF-Token
+// header on unsafe methods, which a cross-site form or script cannot do.
+const (
+	SessionCookieName = "grimoire_session"
+	RefreshCookieName = "grimoire_refresh"
+	CSRFCookieName    = "grimoire_csrf"
+	CSRFHeaderName    = "X-CSRF-Token"
+
+	sessionCookiePath = "/api"
+	refreshCookiePath = "/api/auth/refresh"
+	csrfCookiePath    = "/"
+)
+
+// cookieMaxAge outlives the session itself so that an expired session can still be refreshed from the cookies
+func cookieMaxAge() time.Duration {
+	return envDuration("AUTH_COOKIE_MAX_AGE", 30*24*time.Hour)
+}
+
+func newCookie(name string, value string, path string, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   int(cookieMaxAge().Seconds()),
+		HttpOnly: httpOnly,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+// SessionToken returns the session ID of the request and whether it came from the session cookie.
+// The X-Grimoire-Token header wins when both are sent.
+func SessionToken(r *http.Request) (string, bool) {
+	if sessionID := r.Header.Get("X-Grimoire-Token"); sessionID != "" {
+		return sessionID, false
+	}
+	if cookie, err := r.Cookie(SessionCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, true
+	}
+	return "", false
+}
+
+// SetSessionCookies stores a new session in cookies and returns the CSRF token the client must send back on unsafe methods
+func SetSessionCookies(w http.ResponseWriter, sessionID string, refreshToken string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("set session cookies: %w", err)
+	}
+	csrfToken := hex.EncodeToString(b)
+
+	http.SetCookie(w, newCookie(SessionCookieName, sessionID, sessionCookiePath, true))
+	http.SetCookie(w, newCookie(RefreshCookieName, refreshToken, refreshCookiePath, true))
+	// The CSRF cookie is read by the frontend, so it is the only one that isn't HttpOnly
+	http.SetCookie(w, newCookie(CSRFCookieName, csrfToken, csrfCookiePath, false))
+	return csrfToken, nil
+}
+
+// SetRefreshCookie replaces the refresh token cookie after a refresh and renews the session cookie
+func SetRefreshCookie(w http.ResponseWriter, sessionID string, refreshToken string) {
+	http.SetCookie(w, newCookie(SessionCookieName, sessionID, sessionCookiePath, true))
+	http.SetCookie(w, newCookie(RefreshCookieName, refreshToken, refreshCookiePath, true))
+}
+
+func ClearSessionCookies(w http.ResponseWriter) {
+	for _, c := range []struct{ name, path string }{
+		{SessionCookieName, sessionCookiePath},
+		{RefreshCookieName, refreshCookiePath},
+		{CSRFCookieName, csrfCookiePath},
+	} {
+		cookie := newCookie(c.name, "", c.path, c.name != CSRFCookieName)
+		cookie.MaxAge = -1
+		http.SetCookie(w, cookie)
+	}
+}
+
+// ValidCSRF reports whether a request authenticated by cookie may go ahead. Safe methods don't change
+// anything so they don't need the token; every other method must send the CSRF cookie back as a header.
+func ValidCSRF(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	cookie, err := r.Cookie(CSRFCookieName)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	header := r.Header.Get(CSRFHeaderName)
+	return subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) == 1
+}
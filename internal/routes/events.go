@@ -0,0 +1,47 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// EventStream writes server-sent events. The headers are only sent with the first event, so that a
+// handler can still answer with a normal JSON error when it fails before there is anything to stream.
+type EventStream struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func NewEventStream(w http.ResponseWriter) *EventStream {
+	return &EventStream{w: w}
+}
+
+func (e *EventStream) Started() bool {
+	return e.started
+}
+
+// Send writes one event with the JSON of data, returning an error once the caller has gone away
+func (e *EventStream) Send(event string, data any) error {
+	if !e.started {
+		e.w.Header().Set("Content-Type", "text/event-stream")
+		e.w.Header().Set("Cache-Control", "no-cache")
+		e.w.Header().Set("Connection", "keep-alive")
+		// Stops the nginx reverse proxy from buffering the events
+		e.w.Header().Set("X-Accel-Buffering", "no")
+		e.w.WriteHeader(http.StatusOK)
+		e.started = true
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(e.w, "event: %s\ndata: %s\n\n", event, b); err != nil {
+		return err
+	}
+	if f, ok := e.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/liamrlawrence/sigil-rest_api/internal/audit"
+	"github.com/liamrlawrence/sigil-rest_api/internal/dberr"
+	"github.com/liamrlawrence/sigil-rest_api/internal/logging"
+	"github.com/liamrlawrence/sigil-rest_api/internal/server"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ImpersonatedByHeader is set on every response to an impersonated session, naming the admin behind it
+const ImpersonatedByHeader = "X-Grimoire-Impersonated-By"
+
+const (
+	impersonationTTLDefault = 15 * time.Minute
+	impersonationTTLMax     = time.Hour
+)
+
+// DenyImpersonation keeps impersonated sessions away from routes that change how the user signs in
+func DenyImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, _ := SessionFromContext(r.Context())
+		if session.IsImpersonated() {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "forbidden: not allowed while impersonating a user"
+}`)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HandlerRouteAdminImpersonate opens a session as another user for support and debugging. The session can't be
+// refreshed, and everything it does is marked with the admin who opened it. Auth.FN_Admin_Impersonate refuses
+// to impersonate admins, so an impersonated session never has more access than the user it belongs to.
+func HandlerRouteAdminImpersonate(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type RequestBody struct {
+			Reason          string `json:"reason"`
+			DurationMinutes int    `json:"duration_minutes"`
+		}
+
+		var requestBody RequestBody
+		err := json.NewDecoder(r.Body).Decode(&requestBody)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		username := chi.URLParam(r, "username")
+		logging.APIEndpoint(r, "POST", fmt.Sprintf("/api/admin/users/%s/impersonate", username))
+
+		ttl := impersonationTTLDefault
+		if requestBody.DurationMinutes != 0 {
+			ttl = time.Duration(requestBody.DurationMinutes) * time.Minute
+		}
+		if requestBody.Reason == "" || ttl <= 0 || ttl > impersonationTTLMax {
+			adminBadRequest(w, fmt.Sprintf("request body requires a 'reason', and 'duration_minutes' must be between 1 and %d", int(impersonationTTLMax.Minutes())))
+			return
+		}
+
+		// Impersonating from an impersonated session would hide who is really behind it
+		session, _ := SessionFromContext(r.Context())
+		if session.IsImpersonated() || username == session.Username {
+			adminBadRequest(w, "you can only impersonate another user from your own session")
+			return
+		}
+
+		var sessionID string
+		var expiresAt time.Time
+		err = s.DBPool.QueryRow(context.Background(), "SELECT session_id::TEXT, expires_at FROM Auth.FN_Admin_Impersonate($1::UUID, $2, $3::INTERVAL, $4, $5::INET, $6);",
+			session.ID, username, ttl, requestBody.Reason, ClientIP(r), r.UserAgent()).Scan(&sessionID, &expiresAt)
+		if err != nil {
+			log.Printf("/api/admin/users/impersonate | %v\n", err)
+			dbErr := dberr.From(err)
+			if dbErr == dberr.ErrNotFound {
+				dbErr = dberr.ErrUserNotFound
+			}
+			dbErr.WriteJSON(w)
+			return
+		}
+		RecordAuditEvent(s, r, audit.EventImpersonation, username, sessionID, audit.OutcomeSuccess,
+			fmt.Sprintf("impersonated by %s for %v: %s", session.Username, ttl, requestBody.Reason))
+
+		usernameData, _ := json.Marshal(username)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{
+	"status": "success",
+	"message": "impersonation session opened",
+	"data": {
+		"session_id": "%v",
+		"username": %s,
+		"expires_at": "%v"
+	}
+}`,
+			sessionID, usernameData, expiresAt.Format(time.RFC3339))
+	}
+}
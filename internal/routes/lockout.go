@@ -0,0 +1,244 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/liamrlawrence/sigil-rest_api/internal/audit"
+	"github.com/liamrlawrence/sigil-rest_api/internal/dberr"
+	"github.com/liamrlawrence/sigil-rest_api/internal/logging"
+	"github.com/liamrlawrence/sigil-rest_api/internal/server"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LockoutPolicy decides how failed logins slow down and eventually lock out a username.
+// Failures are kept in Postgres so the limits hold across restarts and replicas.
+type LockoutPolicy struct {
+	Threshold   int
+	Duration    time.Duration
+	Window      time.Duration
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+}
+
+var (
+	lockoutPolicy     LockoutPolicy
+	lockoutPolicyOnce sync.Once
+)
+
+// GetLockoutPolicy reads the AUTH_LOCKOUT_* environment variables the first time it is called
+func GetLockoutPolicy() LockoutPolicy {
+	lockoutPolicyOnce.Do(func() {
+		lockoutPolicy = LockoutPolicy{
+			Threshold:   envInt("AUTH_LOCKOUT_THRESHOLD", 10),
+			Duration:    envDuration("AUTH_LOCKOUT_DURATION", 15*time.Minute),
+			Window:      envDuration("AUTH_LOCKOUT_WINDOW", time.Hour),
+			BackoffBase: envDuration("AUTH_LOCKOUT_BACKOFF_BASE", time.Second),
+			BackoffMax:  envDuration("AUTH_LOCKOUT_BACKOFF_MAX", 5*time.Minute),
+		}
+	})
+	return lockoutPolicy
+}
+
+// Backoff returns how long to wait after the last failure before another attempt is allowed
+func (p LockoutPolicy) Backoff(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	backoff := float64(p.BackoffBase) * math.Pow(2, float64(failures-1))
+	if backoff > float64(p.BackoffMax) {
+		return p.BackoffMax
+	}
+	return time.Duration(backoff)
+}
+
+func envInt(key string, fallback int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || v <= 0 {
+		return fallback
+	}
+	return v
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || v <= 0 {
+		return fallback
+	}
+	return v
+}
+
+// LoginAttempt is a login, or a check of the current password, that counts against the login throttle.
+// The throttle of the username and client IP stays locked in a transaction from the check until the
+// failure is recorded, so parallel guesses wait for each other instead of all passing the check before
+// any of them is counted.
+type LoginAttempt struct {
+	s        *server.Server
+	tx       pgx.Tx
+	username string
+	ip       string
+}
+
+// BeginLoginAttempt writes an error response and returns nil when the username or client IP may not attempt
+// a login yet. Otherwise the caller checks the password with Run, then ends the attempt with Fail or Succeed,
+// and defers Close for every other way out.
+func BeginLoginAttempt(s *server.Server, w http.ResponseWriter, username string, ip string) *LoginAttempt {
+	policy := GetLockoutPolicy()
+
+	tx, err := s.DBPool.Begin(context.Background())
+	if err != nil {
+		log.Printf("/api/auth/login | login throttle: %v\n", err)
+		dberr.From(err).WriteJSON(w)
+		return nil
+	}
+	a := &LoginAttempt{s: s, tx: tx, username: username, ip: ip}
+
+	// Always the username before the IP, so that two attempts never wait on each other's lock
+	_, err = tx.Exec(context.Background(), "SELECT pg_advisory_xact_lock(hashtext('login username ' || $1));", username)
+	if err == nil {
+		_, err = tx.Exec(context.Background(), "SELECT pg_advisory_xact_lock(hashtext('login ip ' || $1));", ip)
+	}
+
+	var usernameFailures, ipFailures int
+	var lastFailureAt, lockedUntil *time.Time
+	if err == nil {
+		err = tx.QueryRow(context.Background(), "SELECT username_failures, ip_failures, last_failure_at, locked_until FROM Auth.FN_Login_Throttle($1, $2::INET, $3::INTERVAL);",
+			username, ip, policy.Window).Scan(&usernameFailures, &ipFailures, &lastFailureAt, &lockedUntil)
+	}
+	if err != nil {
+		log.Printf("/api/auth/login | login throttle: %v\n", err)
+		a.Close()
+		dberr.From(err).WriteJSON(w)
+		return nil
+	}
+
+	now := time.Now()
+	if lockedUntil != nil && now.Before(*lockedUntil) {
+		a.Close()
+		retryAfter := int(math.Ceil(lockedUntil.Sub(now).Seconds()))
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		w.WriteHeader(http.StatusLocked)
+		fmt.Fprintf(w, `{
+	"status": "failed",
+	"message": "account locked after too many failed login attempts",
+	"data": {
+		"retry_after": %d
+	}
+}`, retryAfter)
+		return nil
+	}
+
+	failures := usernameFailures
+	if ipFailures > failures {
+		failures = ipFailures
+	}
+	if lastFailureAt != nil {
+		if wait := lastFailureAt.Add(policy.Backoff(failures)).Sub(now); wait > 0 {
+			a.Close()
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprintf(w, `{
+	"status": "failed",
+	"message": "too many failed login attempts, try again later",
+	"data": {
+		"retry_after": %d
+	}
+}`, retryAfter)
+			return nil
+		}
+	}
+
+	return a
+}
+
+// Run checks the password with fn inside the transaction of the attempt. An error from fn only rolls back
+// what fn did, so the failure can still be recorded afterwards.
+func (a *LoginAttempt) Run(fn func(tx pgx.Tx) error) error {
+	savepoint, err := a.tx.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	if err := fn(savepoint); err != nil {
+		savepoint.Rollback(context.Background())
+		return err
+	}
+	return savepoint.Commit(context.Background())
+}
+
+// Fail counts the failed attempt, locking the username once it reaches the policy threshold
+func (a *LoginAttempt) Fail(r *http.Request) {
+	policy := GetLockoutPolicy()
+	defer a.Close()
+
+	var locked bool
+	err := a.tx.QueryRow(context.Background(), "CALL Auth.SP_Record_Login_Failure($1, $2::INET, $3::INT, $4::INTERVAL, $5::INTERVAL, NULL);",
+		a.username, a.ip, policy.Threshold, policy.Duration, policy.Window).Scan(&locked)
+	if err == nil {
+		err = a.tx.Commit(context.Background())
+	}
+	if err != nil {
+		log.Printf("/api/auth/login | record login failure: %v\n", err)
+		return
+	}
+
+	if locked {
+		RecordAuditEvent(a.s, r, audit.EventLockout, a.username, "", audit.OutcomeSuccess, fmt.Sprintf("locked for %v", policy.Duration))
+	}
+}
+
+// Succeed clears the failures of the username and commits what Run did. The failures of the IP are left
+// alone, otherwise anyone could reset them by signing in to their own account between guesses.
+func (a *LoginAttempt) Succeed() error {
+	defer a.Close()
+
+	_, err := a.tx.Exec(context.Background(), "CALL Auth.SP_Clear_Login_Failures($1, NULL);", a.username)
+	if err != nil {
+		log.Printf("/api/auth/login | clear login failures: %v\n", err)
+	}
+	return a.tx.Commit(context.Background())
+}
+
+// Continue commits what Run did but leaves the failures of the username alone, for a right password when
+// a second factor is still to come. The failures are only cleared once that succeeds too.
+func (a *LoginAttempt) Continue() error {
+	defer a.Close()
+	return a.tx.Commit(context.Background())
+}
+
+// Close rolls back an attempt that was neither failed nor succeeded, and does nothing after either
+func (a *LoginAttempt) Close() {
+	a.tx.Rollback(context.Background())
+}
+
+func HandlerRouteAdminUnlockUser(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "username")
+		logging.APIEndpoint(r, "POST", fmt.Sprintf("/api/admin/users/%s/unlock", username))
+
+		_, err := s.DBPool.Exec(context.Background(), "CALL Auth.SP_Unlock_User($1);", username)
+		if err != nil {
+			log.Printf("/api/admin/users/unlock | %v\n", err)
+			dberr.From(err).WriteJSON(w)
+			return
+		}
+		session, _ := SessionFromContext(r.Context())
+		RecordAuditEvent(s, r, audit.EventUnlock, username, "", audit.OutcomeSuccess, fmt.Sprintf("unlocked by %s", session.Username))
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{
+	"status": "success",
+	"message": "account unlocked"
+}`)
+	}
+}
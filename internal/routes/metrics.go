@@ -0,0 +1,24 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/liamrlawrence/sigil-rest_api/internal/logging"
+	"github.com/liamrlawrence/sigil-rest_api/internal/server"
+	"net/http"
+)
+
+func HandlerRouteSessionCacheMetrics(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logging.APIEndpoint(r, "GET", "/api/metrics/session-cache")
+
+		data, _ := json.Marshal(s.SessionCache.Stats())
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{
+	"status": "success",
+	"message": "got session cache metrics",
+	"data": %s
+}`, data)
+	}
+}
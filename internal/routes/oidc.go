@@ -0,0 +1,179 @@
+package routes
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"github.com/liamrlawrence/sigil-rest_api/internal/audit"
+	"github.com/liamrlawrence/sigil-rest_api/internal/dberr"
+	"github.com/liamrlawrence/sigil-rest_api/internal/logging"
+	"github.com/liamrlawrence/sigil-rest_api/internal/oidc"
+	"github.com/liamrlawrence/sigil-rest_api/internal/server"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	oidcLoginTTL = 10 * time.Minute
+
+	// The state is also kept in a cookie, so that a callback only finishes a login started by the same browser.
+	// It has to be SameSite Lax, since the identity provider sends the browser back with a cross-site navigation.
+	oidcStateCookieName = "grimoire_oidc_state"
+	oidcStateCookiePath = "/api/auth/oidc/callback"
+)
+
+func setOIDCStateCookie(w http.ResponseWriter, state string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     oidcStateCookiePath,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func oidcDisabled(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "oidc login is not enabled"
+}`)
+}
+
+// HandlerRouteAuthOIDCStart redirects to the identity provider, remembering the state, nonce and PKCE verifier for the callback
+func HandlerRouteAuthOIDCStart(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logging.APIEndpoint(r, "GET", "/api/auth/oidc/start")
+
+		if s.OIDC == nil {
+			oidcDisabled(w)
+			return
+		}
+
+		var values [3]string
+		for i := range values {
+			v, err := oidc.RandomString()
+			if err != nil {
+				log.Printf("/api/auth/oidc/start | %v\n", err)
+				dberr.ErrUnknown.WriteJSON(w)
+				return
+			}
+			values[i] = v
+		}
+		state, nonce, verifier := values[0], values[1], values[2]
+
+		authURL, err := s.OIDC.AuthCodeURL(r.Context(), state, nonce, verifier)
+		if err != nil {
+			log.Printf("/api/auth/oidc/start | %v\n", err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "identity provider is unavailable"
+}`)
+			return
+		}
+
+		_, err = s.DBPool.Exec(context.Background(), "CALL Auth.SP_Create_OIDC_Login($1, $2, $3, $4::INTERVAL);",
+			HashToken(state), nonce, verifier, oidcLoginTTL)
+		if err != nil {
+			log.Printf("/api/auth/oidc/start | %v\n", err)
+			dberr.From(err).WriteJSON(w)
+			return
+		}
+
+		setOIDCStateCookie(w, state, int(oidcLoginTTL.Seconds()))
+		http.Redirect(w, r, authURL, http.StatusFound)
+	}
+}
+
+// HandlerRouteAuthOIDCCallback finishes the authorization code flow and signs in the Auth user linked to the identity.
+// The callback is a top-level navigation, so the session is set in cookies and the browser is sent on to the frontend.
+func HandlerRouteAuthOIDCCallback(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logging.APIEndpoint(r, "GET", "/api/auth/oidc/callback")
+
+		if s.OIDC == nil {
+			oidcDisabled(w)
+			return
+		}
+
+		query := r.URL.Query()
+		setOIDCStateCookie(w, "", -1)
+		if e := query.Get("error"); e != "" {
+			log.Printf("/api/auth/oidc/callback | identity provider returned %s: %s\n", e, query.Get("error_description"))
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "sign in was cancelled or refused by the identity provider"
+}`)
+			return
+		}
+
+		state := query.Get("state")
+		cookie, err := r.Cookie(oidcStateCookieName)
+		if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+			log.Printf("/api/auth/oidc/callback | state doesn't match the state cookie\n")
+			dberr.ErrInvalidOIDCState.WriteJSON(w)
+			return
+		}
+
+		// The login can only be finished once, and only before it expires
+		var nonce, verifier string
+		err = s.DBPool.QueryRow(context.Background(), "SELECT nonce, code_verifier FROM Auth.FN_Consume_OIDC_Login($1);",
+			HashToken(state)).Scan(&nonce, &verifier)
+		if err != nil {
+			log.Printf("/api/auth/oidc/callback | %v\n", err)
+			dbErr := dberr.From(err)
+			if dbErr == dberr.ErrNotFound {
+				dbErr = dberr.ErrInvalidOIDCState
+			}
+			dbErr.WriteJSON(w)
+			return
+		}
+
+		claims, err := s.OIDC.Exchange(r.Context(), query.Get("code"), verifier, nonce)
+		if err != nil {
+			log.Printf("/api/auth/oidc/callback | %v\n", err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "failed to verify sign in with the identity provider"
+}`)
+			return
+		}
+
+		// Only trust the email for linking or creating the user when the identity provider verified it
+		email := ""
+		if claims.EmailVerified {
+			email = claims.Email
+		}
+
+		var username string
+		var sessionID string
+		var refreshToken string
+		err = s.DBPool.QueryRow(context.Background(), "SELECT username, session_id, refresh_token FROM Auth.FN_OIDC_LogIn($1, $2, $3, $4, $5, $6::INET, $7);",
+			claims.Issuer, claims.Subject, email, claims.PreferredUsername, s.OIDC.Config.AllowSignUp, ClientIP(r), r.UserAgent()).Scan(&username, &sessionID, &refreshToken)
+		if err != nil {
+			log.Printf("/api/auth/oidc/callback | %v\n", err)
+			dbErr := dberr.From(err)
+			RecordAuditEvent(s, r, audit.EventLoginFailure, "", "", audit.OutcomeFailure, fmt.Sprintf("oidc %s: %s", claims.Subject, dbErr.Code))
+			dbErr.WriteJSON(w)
+			return
+		}
+		RecordAuditEvent(s, r, audit.EventLoginSuccess, username, sessionID, audit.OutcomeSuccess, "oidc")
+
+		if _, err := SetSessionCookies(w, sessionID, refreshToken); err != nil {
+			log.Printf("/api/auth/oidc/callback | %v\n", err)
+			dberr.ErrUnknown.WriteJSON(w)
+			return
+		}
+		http.Redirect(w, r, s.OIDC.Config.PostLoginURL, http.StatusFound)
+	}
+}
@@ -0,0 +1,251 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/liamrlawrence/sigil-rest_api/internal/audit"
+	"github.com/liamrlawrence/sigil-rest_api/internal/dberr"
+	"github.com/liamrlawrence/sigil-rest_api/internal/logging"
+	"github.com/liamrlawrence/sigil-rest_api/internal/mailer"
+	"github.com/liamrlawrence/sigil-rest_api/internal/server"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const passwordResetTTL = 30 * time.Minute
+
+func HandlerRouteAuthPasswordResetRequest(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type RequestBody struct {
+			Email string `json:"email"`
+		}
+
+		var requestBody RequestBody
+		err := json.NewDecoder(r.Body).Decode(&requestBody)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		email := requestBody.Email
+		logging.APIEndpoint(r, "POST", fmt.Sprintf("/api/auth/password-reset/request - %s", email))
+
+		// Always give the same answer so the endpoint can't be used to find out which emails have accounts
+		accepted := func() {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprint(w, `{
+	"status": "success",
+	"message": "if an account exists for that email, a password reset email has been sent"
+}`)
+		}
+
+		if ValidateEmail(email) != nil {
+			accepted()
+			return
+		}
+
+		// Only the hash of the token is stored, the token itself is only ever sent in the email
+		token, tokenHash, err := NewOpaqueToken("")
+		if err != nil {
+			log.Printf("/api/auth/password-reset/request | %v\n", err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "Unknown error"
+}`)
+			return
+		}
+
+		var username string
+		err = s.DBPool.QueryRow(context.Background(), "SELECT username FROM Auth.FN_Create_Password_Reset($1, $2, $3::INTERVAL);",
+			email, tokenHash, passwordResetTTL).Scan(&username)
+		if err != nil {
+			// No account for that email, or the database refused the request
+			log.Printf("/api/auth/password-reset/request | %v\n", err)
+			accepted()
+			return
+		}
+
+		RecordAuditEvent(s, r, audit.EventPasswordReset, username, "", audit.OutcomeSuccess, "")
+		SendPasswordResetEmail(s, r, username, email, token, fmt.Sprintf(`Someone asked to reset the password for your account. If it was you, use the token below within %d minutes to choose a new password.
+If you didn't ask for this, you can ignore this email.`, int(passwordResetTTL.Minutes())))
+
+		accepted()
+	}
+}
+
+// passwordResetEmailTimeout bounds how long a reset email may take to send once the response has gone
+const passwordResetEmailTimeout = time.Minute
+
+// SendPasswordResetEmail emails the reset token after the intro, and a link to use it when PASSWORD_RESET_URL is set.
+// The email is sent in the background, so how long the request takes doesn't tell the caller whether an
+// account exists. Failures are only logged.
+func SendPasswordResetEmail(s *server.Server, r *http.Request, username string, email string, token string, intro string) {
+	body := fmt.Sprintf(`Hi %s,
+
+%s
+
+%s
+`, username, intro, token)
+	if resetURL := os.Getenv("PASSWORD_RESET_URL"); resetURL != "" {
+		body += fmt.Sprintf("\nOr follow this link: %s?token=%s\n", resetURL, token)
+	}
+
+	path := r.URL.Path
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), passwordResetEmailTimeout)
+		defer cancel()
+
+		err := s.Mailer.Send(ctx, mailer.Message{
+			To:      email,
+			Subject: "Password reset",
+			Body:    body,
+		})
+		if err != nil {
+			log.Printf("%s | %v\n", path, err)
+		}
+	}()
+}
+
+func HandlerRouteAuthPasswordResetConfirm(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type RequestBody struct {
+			Token           string `json:"token"`
+			Password        string `json:"password"`
+			PasswordConfirm string `json:"password_confirm"`
+		}
+
+		var requestBody RequestBody
+		err := json.NewDecoder(r.Body).Decode(&requestBody)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		logging.APIEndpoint(r, "POST", "/api/auth/password-reset/confirm")
+
+		err = ValidatePassword(requestBody.Password, requestBody.PasswordConfirm)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{
+	"status": "failed",
+	"message": "%v"
+}`, err)
+			return
+		}
+
+		// Consumes the token, sets the new password and revokes every session of the user
+		var username string
+		err = s.DBPool.QueryRow(context.Background(), "CALL Auth.SP_Confirm_Password_Reset($1, $2, NULL);",
+			HashToken(requestBody.Token), requestBody.Password).Scan(&username)
+		if err != nil {
+			log.Printf("/api/auth/password-reset/confirm | %v\n", err)
+			dberr.From(err).WriteJSON(w)
+			return
+		}
+		s.SessionCache.NotifyUser(context.Background(), s.DBPool, username)
+		RecordAuditEvent(s, r, audit.EventPasswordChange, username, "", audit.OutcomeSuccess, "password reset, revoked every session")
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{
+	"status": "success",
+	"message": "password has been reset"
+}`)
+	}
+}
+
+// HandlerRouteAuthChangePassword changes the password of the caller after checking their current one. With
+// revoke_other_sessions every session of the user is revoked, and the caller gets a fresh session in place of theirs.
+func HandlerRouteAuthChangePassword(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type RequestBody struct {
+			CurrentPassword     string `json:"current_password"`
+			Password            string `json:"password"`
+			PasswordConfirm     string `json:"password_confirm"`
+			RevokeOtherSessions bool   `json:"revoke_other_sessions"`
+		}
+
+		var requestBody RequestBody
+		err := json.NewDecoder(r.Body).Decode(&requestBody)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		logging.APIEndpoint(r, "POST", "/api/auth/password")
+
+		err = ValidatePassword(requestBody.Password, requestBody.PasswordConfirm)
+		if err == nil && requestBody.Password == requestBody.CurrentPassword {
+			err = errors.New("new password must be different from the current password")
+		}
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{
+	"status": "failed",
+	"message": "%v"
+}`, err)
+			return
+		}
+
+		// A stolen session must not be a way around the login throttle for guessing the current password
+		session, _ := SessionFromContext(r.Context())
+		ip := ClientIP(r)
+		attempt := BeginLoginAttempt(s, w, session.Username, ip)
+		if attempt == nil {
+			return
+		}
+		defer attempt.Close()
+
+		var sessionID string
+		var refreshToken string
+		err = attempt.Run(func(tx pgx.Tx) error {
+			return tx.QueryRow(context.Background(), `SELECT COALESCE(session_id::TEXT, ''), COALESCE(refresh_token::TEXT, '')
+FROM Auth.FN_Change_Password($1::UUID, $2, $3, $4, $5::INET, $6);`,
+				session.ID, requestBody.CurrentPassword, requestBody.Password, requestBody.RevokeOtherSessions, ip, r.UserAgent()).Scan(&sessionID, &refreshToken)
+		})
+		if err != nil {
+			log.Printf("/api/auth/password | %v\n", err)
+			dbErr := dberr.From(err)
+			if dbErr == dberr.ErrIncorrectPassword {
+				attempt.Fail(r)
+				RecordAuditEvent(s, r, audit.EventPasswordChange, session.Username, session.ID, audit.OutcomeFailure, "incorrect current password")
+			}
+			dbErr.WriteJSON(w)
+			return
+		}
+		err = attempt.Succeed()
+		if err != nil {
+			log.Printf("/api/auth/password | %v\n", err)
+			dberr.From(err).WriteJSON(w)
+			return
+		}
+
+		if !requestBody.RevokeOtherSessions {
+			RecordAuditEvent(s, r, audit.EventPasswordChange, session.Username, session.ID, audit.OutcomeSuccess, "")
+
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, `{
+	"status": "success",
+	"message": "password changed"
+}`)
+			return
+		}
+
+		// Every session was revoked, including the current one, so the caller continues on the new session
+		s.SessionCache.NotifyUser(context.Background(), s.DBPool, session.Username)
+		RecordAuditEvent(s, r, audit.EventPasswordChange, session.Username, sessionID, audit.OutcomeSuccess, "revoked every other session")
+
+		WriteSignedIn(w, r, http.StatusOK, "password changed, every other session was revoked", sessionID, refreshToken, session.FromCookie)
+	}
+}
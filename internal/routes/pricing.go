@@ -0,0 +1,127 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/liamrlawrence/sigil-rest_api/internal/dberr"
+	"github.com/liamrlawrence/sigil-rest_api/internal/logging"
+	"github.com/liamrlawrence/sigil-rest_api/internal/server"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Prices are kept per upstream model in AI.Model_Prices, in dollars per million tokens. A new price never
+// replaces an old one, it takes over from its effective date, so bills keep the cost they were inserted with.
+
+type ModelPrice struct {
+	UpstreamID    string    `json:"upstream_id"`
+	InputPrice    float64   `json:"input_price"`
+	OutputPrice   float64   `json:"output_price"`
+	EffectiveFrom time.Time `json:"effective_from"`
+}
+
+// HandlerRouteAdminModelPrices lists the price history, newest first, optionally for one upstream model
+func HandlerRouteAdminModelPrices(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logging.APIEndpoint(r, "GET", "/api/admin/ai/prices")
+
+		rows, err := s.DBPool.Query(context.Background(), `SELECT upstream_id, input_price, output_price, effective_from
+FROM AI.FN_List_Model_Prices(NULLIF($1, ''));`, r.URL.Query().Get("upstream_id"))
+		if err != nil {
+			log.Printf("/api/admin/ai/prices | %v\n", err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "failed to get model prices"
+}`)
+			return
+		}
+		defer rows.Close()
+
+		prices := []ModelPrice{}
+		for rows.Next() {
+			var p ModelPrice
+			err = rows.Scan(&p.UpstreamID, &p.InputPrice, &p.OutputPrice, &p.EffectiveFrom)
+			if err != nil {
+				break
+			}
+			prices = append(prices, p)
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		if err != nil {
+			log.Printf("/api/admin/ai/prices | %v\n", err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "failed to get model prices during query"
+}`)
+			return
+		}
+
+		data, _ := json.Marshal(prices)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{
+	"status": "success",
+	"message": "got model prices",
+	"data": %s
+}`, data)
+	}
+}
+
+// HandlerRouteAdminSetModelPrice adds a price for an upstream model, taking effect now unless the
+// request gives an effective_from
+func HandlerRouteAdminSetModelPrice(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type RequestBody struct {
+			UpstreamID    string     `json:"upstream_id"`
+			InputPrice    *float64   `json:"input_price"`
+			OutputPrice   *float64   `json:"output_price"`
+			EffectiveFrom *time.Time `json:"effective_from"`
+		}
+
+		var requestBody RequestBody
+		err := json.NewDecoder(r.Body).Decode(&requestBody)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		logging.APIEndpoint(r, "POST", fmt.Sprintf("/api/admin/ai/prices - %s", requestBody.UpstreamID))
+
+		if requestBody.UpstreamID == "" || requestBody.InputPrice == nil || requestBody.OutputPrice == nil {
+			adminBadRequest(w, "request body requires fields 'upstream_id', 'input_price' and 'output_price'")
+			return
+		}
+		if *requestBody.InputPrice < 0 || *requestBody.OutputPrice < 0 {
+			adminBadRequest(w, "prices can't be negative")
+			return
+		}
+
+		var price ModelPrice
+		err = s.DBPool.QueryRow(context.Background(), `SELECT upstream_id, input_price, output_price, effective_from
+FROM AI.FN_Insert_Model_Price($1, $2, $3, $4::TIMESTAMPTZ);`,
+			requestBody.UpstreamID, *requestBody.InputPrice, *requestBody.OutputPrice, requestBody.EffectiveFrom).Scan(
+			&price.UpstreamID, &price.InputPrice, &price.OutputPrice, &price.EffectiveFrom)
+		if err != nil {
+			log.Printf("/api/admin/ai/prices | %v\n", err)
+			dberr.From(err).WriteJSON(w)
+			return
+		}
+
+		data, _ := json.Marshal(price)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{
+	"status": "success",
+	"message": "price added",
+	"data": %s
+}`, data)
+	}
+}
@@ -0,0 +1,74 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	RoleAdmin    = "admin"
+	RoleOperator = "operator"
+	RoleUser     = "user"
+)
+
+var roles = []string{RoleAdmin, RoleOperator, RoleUser}
+
+// RequireRole only lets callers whose session has one of the given roles through to the handler
+func RequireRole(roles ...string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session, ok := SessionFromContext(r.Context())
+			if ok {
+				for _, role := range roles {
+					if session.Role == role {
+						next.ServeHTTP(w, r)
+						return
+					}
+				}
+			}
+
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, `{
+	"status": "failed",
+	"message": "forbidden: requires role %s"
+}`, strings.Join(roles, " or "))
+		})
+	}
+}
+
+const (
+	ScopeAIChat   = "ai:chat"
+	ScopeAIBills  = "ai:bills"
+	ScopeBotoLogs = "boto:logs"
+)
+
+var apiKeyScopes = []string{ScopeAIChat, ScopeAIBills, ScopeBotoLogs}
+
+// RequireScope only lets API keys with the given scope through, sessions are not limited by scopes
+func RequireScope(scope string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session, ok := SessionFromContext(r.Context())
+			if ok && session.IsAPIKey() {
+				for _, s := range session.Scopes {
+					if s == scope {
+						next.ServeHTTP(w, r)
+						return
+					}
+				}
+
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintf(w, `{
+	"status": "failed",
+	"message": "forbidden: API key requires scope %s"
+}`, scope)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -2,6 +2,7 @@ package routes
 
 import (
 	"fmt"
+	"github.com/go-chi/chi/v5"
 	"github.com/liamrlawrence/sigil-rest_api/internal/logging"
 	"github.com/liamrlawrence/sigil-rest_api/internal/server"
 	"net/http"
@@ -9,21 +10,102 @@ import (
 
 func SetupEndpoints(s *server.Server) {
 	// Services
-	s.Router.Get("/api/heartbeat", HandlerRouteHeartbeat(s))
-	s.Router.Post("/api/heartbeat", HandlerRouteHeartbeat(s))
+	s.Router.Group(func(r chi.Router) {
+		r.Use(Authenticate(s, AuthAPIKey))
+		r.Get("/api/heartbeat", HandlerRouteHeartbeat(s))
+		r.Post("/api/heartbeat", HandlerRouteHeartbeat(s))
+	})
 
 	// auth
-	//s.Router.Post("/api/auth/sign-up", HandlerRouteAuthSignUp(s)) // in: username, email, 2xpassword
-	s.Router.Post("/api/auth/login", HandlerRouteAuthLogIn(s))
-	s.Router.Post("/api/auth/refresh", HandlerRouteAuthRefresh(s))
+	s.Router.Group(func(r chi.Router) {
+		r.Use(Authenticate(s, AuthPublic))
+		r.Post("/api/auth/sign-up", HandlerRouteAuthSignUp(s))
+		r.Post("/api/auth/login", HandlerRouteAuthLogIn(s))
+		r.Post("/api/auth/login/totp", HandlerRouteAuthLogInTOTP(s))
+		r.Get("/api/auth/oidc/start", HandlerRouteAuthOIDCStart(s))
+		r.Get("/api/auth/oidc/callback", HandlerRouteAuthOIDCCallback(s))
+		r.Post("/api/auth/password-reset/request", HandlerRouteAuthPasswordResetRequest(s))
+		r.Post("/api/auth/password-reset/confirm", HandlerRouteAuthPasswordResetConfirm(s))
+	})
+	s.Router.Group(func(r chi.Router) {
+		r.Use(Authenticate(s, AuthSessionAllowExpired))
+		r.Post("/api/auth/refresh", HandlerRouteAuthRefresh(s))
+	})
+	s.Router.Group(func(r chi.Router) {
+		r.Use(Authenticate(s, AuthSession))
+		r.Post("/api/auth/logout", HandlerRouteAuthLogOut(s))
+		r.Get("/api/auth/sessions", HandlerRouteAuthSessions(s))
+		r.Delete("/api/auth/sessions", HandlerRouteAuthRevokeOtherSessions(s))
+		r.Delete("/api/auth/sessions/{sessionRef}", HandlerRouteAuthRevokeSession(s))
+		r.Get("/api/auth/keys", HandlerRouteAuthAPIKeys(s))
+		r.Delete("/api/auth/keys/{keyID}", HandlerRouteAuthRevokeAPIKey(s))
+	})
+	s.Router.Group(func(r chi.Router) {
+		r.Use(Authenticate(s, AuthSession))
+		r.Use(DenyImpersonation)
+		r.Post("/api/auth/password", HandlerRouteAuthChangePassword(s))
+		r.Post("/api/auth/keys", HandlerRouteAuthCreateAPIKey(s))
+		r.Post("/api/auth/totp/enroll", HandlerRouteAuthTOTPEnroll(s))
+		r.Post("/api/auth/totp/confirm", HandlerRouteAuthTOTPConfirm(s))
+	})
 
 	// ai
-	s.Router.Get("/api/ai/bills", HandlerRouteAIBills(s))
-	s.Router.Post("/api/ai/gpt3", HandlerRouteChatGPT35_Turbo(s))
-	s.Router.Post("/api/ai/gpt4", HandlerRouteChatGPT4(s))
+	s.Router.Group(func(r chi.Router) {
+		r.Use(Authenticate(s, AuthAPIKey))
+		r.Use(RequireRole(RoleAdmin, RoleOperator, RoleUser))
+		r.Use(RequireScope(ScopeAIChat))
+		r.Get("/api/ai/models", HandlerRouteAIModels(s))
+		r.Post("/api/ai/chat", HandlerRouteAIChat(s))
+		r.Post("/api/ai/gpt3", HandlerRouteChatGPT35_Turbo(s))
+		r.Post("/api/ai/gpt4", HandlerRouteChatGPT4(s))
+		r.Post("/api/ai/conversations", HandlerRouteAICreateConversation(s))
+		r.Get("/api/ai/conversations", HandlerRouteAIConversations(s))
+		r.Get("/api/ai/conversations/{conversationID}", HandlerRouteAIConversation(s))
+		r.Delete("/api/ai/conversations/{conversationID}", HandlerRouteAIDeleteConversation(s))
+		r.Post("/api/ai/conversations/{conversationID}/messages", HandlerRouteAIConversationMessage(s))
+	})
+	s.Router.Group(func(r chi.Router) {
+		r.Use(Authenticate(s, AuthAPIKey))
+		r.Use(RequireRole(RoleAdmin))
+		r.Use(RequireScope(ScopeAIBills))
+		r.Get("/api/ai/bills", HandlerRouteAIBills(s))
+	})
 
 	// docker
-	s.Router.Get("/api/boto/logs", HandlerRouteBotoLogs(s))
+	s.Router.Group(func(r chi.Router) {
+		r.Use(Authenticate(s, AuthAPIKey))
+		r.Use(RequireRole(RoleAdmin, RoleOperator))
+		r.Use(RequireScope(ScopeBotoLogs))
+		r.Get("/api/boto/logs", HandlerRouteBotoLogs(s))
+	})
+
+	// admin
+	s.Router.Group(func(r chi.Router) {
+		r.Use(Authenticate(s, AuthSession))
+		r.Use(RequireRole(RoleAdmin))
+		r.Post("/api/admin/users", HandlerRouteAdminCreateUser(s))
+		r.Get("/api/admin/users", HandlerRouteAdminUsers(s))
+		r.Put("/api/admin/users/{username}/role", HandlerRouteAdminSetUserRole(s))
+		r.Post("/api/admin/users/{username}/disable", HandlerRouteAdminSetUserDisabled(s, true))
+		r.Post("/api/admin/users/{username}/enable", HandlerRouteAdminSetUserDisabled(s, false))
+		r.Post("/api/admin/users/{username}/password-reset", HandlerRouteAdminForcePasswordReset(s))
+		r.Post("/api/admin/users/{username}/impersonate", HandlerRouteAdminImpersonate(s))
+		r.Post("/api/admin/users/{username}/unlock", HandlerRouteAdminUnlockUser(s))
+		r.Get("/api/admin/audit", HandlerRouteAdminAuditEvents(s))
+		r.Post("/api/admin/ai/models/reload", HandlerRouteAdminReloadModels(s))
+		r.Get("/api/admin/ai/prices", HandlerRouteAdminModelPrices(s))
+		r.Post("/api/admin/ai/prices", HandlerRouteAdminSetModelPrice(s))
+		r.Get("/api/admin/ai/budgets", HandlerRouteAdminBudgets(s))
+		r.Put("/api/admin/ai/budgets", HandlerRouteAdminSetBudget(s))
+		r.Delete("/api/admin/ai/budgets", HandlerRouteAdminDeleteBudget(s))
+	})
+
+	// metrics
+	s.Router.Group(func(r chi.Router) {
+		r.Use(Authenticate(s, AuthSession))
+		r.Use(RequireRole(RoleAdmin))
+		r.Get("/api/metrics/session-cache", HandlerRouteSessionCacheMetrics(s))
+	})
 
 	// 404
 	s.Router.NotFound(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,144 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/liamrlawrence/sigil-rest_api/internal/audit"
+	"github.com/liamrlawrence/sigil-rest_api/internal/dberr"
+	"github.com/liamrlawrence/sigil-rest_api/internal/logging"
+	"github.com/liamrlawrence/sigil-rest_api/internal/server"
+	"log"
+	"net/http"
+	"time"
+)
+
+// HandlerRouteAuthSessions lists the active sessions of the caller. Sessions are identified by a
+// public session_ref so that the session IDs of other clients are never exposed.
+func HandlerRouteAuthSessions(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	type Session struct {
+		SessionRef string    `json:"session_ref"`
+		CreatedAt  time.Time `json:"created_at"`
+		LastSeenAt time.Time `json:"last_seen_at"`
+		ExpiresAt  time.Time `json:"expires_at"`
+		IPAddress  string    `json:"ip_address"`
+		UserAgent  string    `json:"user_agent"`
+		Current    bool      `json:"current"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logging.APIEndpoint(r, "GET", "/api/auth/sessions")
+
+		session, _ := SessionFromContext(r.Context())
+		rows, err := s.DBPool.Query(context.Background(), `SELECT session_ref::TEXT, created_at, last_seen_at, expires_at, COALESCE(host(ip_address), ''), COALESCE(user_agent, ''), is_current
+FROM Auth.FN_List_Sessions($1::UUID);`, session.ID)
+		if err != nil {
+			log.Printf("/api/auth/sessions | %v\n", err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "failed to get sessions"
+}`)
+			return
+		}
+		defer rows.Close()
+
+		sessions := []Session{}
+		for rows.Next() {
+			var session Session
+			err = rows.Scan(&session.SessionRef, &session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt,
+				&session.IPAddress, &session.UserAgent, &session.Current)
+			if err != nil {
+				log.Printf("/api/auth/sessions | %v\n", err)
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "failed to get sessions during query"
+}`)
+				return
+			}
+			sessions = append(sessions, session)
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("/api/auth/sessions | %v\n", err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "failed to get sessions during query"
+}`)
+			return
+		}
+
+		data, _ := json.Marshal(sessions)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{
+	"status": "success",
+	"message": "got active sessions",
+	"data": %s
+}`, data)
+	}
+}
+
+func HandlerRouteAuthRevokeSession(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionRef := chi.URLParam(r, "sessionRef")
+		logging.APIEndpoint(r, "DELETE", fmt.Sprintf("/api/auth/sessions/%s", sessionRef))
+
+		session, _ := SessionFromContext(r.Context())
+		sessionID := session.ID
+		_, err := s.DBPool.Exec(context.Background(), "CALL Auth.SP_Revoke_Session($1::UUID, $2::UUID);", sessionID, sessionRef)
+		s.SessionCache.NotifyUser(context.Background(), s.DBPool, session.Username)
+		if err != nil {
+			log.Printf("/api/auth/sessions | %v\n", err)
+			dbErr := dberr.From(err)
+			if dbErr == dberr.ErrMalformedID {
+				dbErr = dberr.ErrSessionNotFound
+			}
+			dbErr.WriteJSON(w)
+			return
+		}
+		RecordAuditEvent(s, r, audit.EventSessionRevoked, session.Username, sessionID, audit.OutcomeSuccess, fmt.Sprintf("revoked session %s", sessionRef))
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{
+	"status": "success",
+	"message": "session revoked"
+}`)
+	}
+}
+
+// HandlerRouteAuthRevokeOtherSessions revokes every session of the caller except the one making the request
+func HandlerRouteAuthRevokeOtherSessions(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logging.APIEndpoint(r, "DELETE", "/api/auth/sessions")
+
+		session, _ := SessionFromContext(r.Context())
+		sessionID := session.ID
+		_, err := s.DBPool.Exec(context.Background(), "CALL Auth.SP_Revoke_Other_Sessions($1::UUID);", sessionID)
+		s.SessionCache.NotifyUser(context.Background(), s.DBPool, session.Username)
+		if err != nil {
+			log.Printf("/api/auth/sessions | %v\n", err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "Unknown error"
+}`)
+			return
+		}
+		RecordAuditEvent(s, r, audit.EventSessionRevoked, session.Username, sessionID, audit.OutcomeSuccess, "revoked every other session")
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{
+	"status": "success",
+	"message": "other sessions revoked"
+}`)
+	}
+}
@@ -0,0 +1,298 @@
+package routes
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/liamrlawrence/sigil-rest_api/internal/audit"
+	"github.com/liamrlawrence/sigil-rest_api/internal/dberr"
+	"github.com/liamrlawrence/sigil-rest_api/internal/logging"
+	"github.com/liamrlawrence/sigil-rest_api/internal/server"
+	"github.com/liamrlawrence/sigil-rest_api/internal/totp"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	totpIssuer         = "Grimoire"
+	totpChallengeTTL   = 5 * time.Minute
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10
+)
+
+// NewRecoveryCodes returns single-use recovery codes formatted as xxxxx-xxxxx, and the hashes to store in place of them
+func NewRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, recoveryCodeLength/2)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, fmt.Errorf("new recovery codes: %w", err)
+		}
+		code := hex.EncodeToString(b)
+		codes[i] = code[:recoveryCodeLength/2] + "-" + code[recoveryCodeLength/2:]
+		hashes[i] = HashToken(normalizeRecoveryCode(codes[i]))
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// HandlerRouteAuthTOTPEnroll starts enrolling a TOTP secret. It takes the current password, so that a stolen
+// session can't be used to lock the owner out with a second factor only the thief has.
+func HandlerRouteAuthTOTPEnroll(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type RequestBody struct {
+			CurrentPassword string `json:"current_password"`
+		}
+
+		var requestBody RequestBody
+		err := json.NewDecoder(r.Body).Decode(&requestBody)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		logging.APIEndpoint(r, "POST", "/api/auth/totp/enroll")
+
+		secret, err := totp.GenerateSecret()
+		if err != nil {
+			log.Printf("/api/auth/totp/enroll | %v\n", err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "Unknown error"
+}`)
+			return
+		}
+
+		// Guesses at the current password count towards the login throttle, the same as changing the password
+		session, _ := SessionFromContext(r.Context())
+		attempt := BeginLoginAttempt(s, w, session.Username, ClientIP(r))
+		if attempt == nil {
+			return
+		}
+		defer attempt.Close()
+
+		// The secret stays pending until it is confirmed with a first code
+		err = attempt.Run(func(tx pgx.Tx) error {
+			_, err := tx.Exec(context.Background(), "CALL Auth.SP_Begin_TOTP_Enrollment($1::UUID, $2, $3);",
+				session.ID, requestBody.CurrentPassword, secret)
+			return err
+		})
+		if err != nil {
+			log.Printf("/api/auth/totp/enroll | %v\n", err)
+			dbErr := dberr.From(err)
+			if dbErr == dberr.ErrIncorrectPassword {
+				attempt.Fail(r)
+			}
+			dbErr.WriteJSON(w)
+			return
+		}
+		err = attempt.Succeed()
+		if err != nil {
+			log.Printf("/api/auth/totp/enroll | %v\n", err)
+			dberr.From(err).WriteJSON(w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{
+	"status": "success",
+	"message": "totp enrollment started, confirm it with a code from your authenticator",
+	"data": {
+		"secret": "%v",
+		"provisioning_uri": "%v"
+	}
+}`,
+			secret, totp.ProvisioningURI(totpIssuer, session.Username, secret))
+	}
+}
+
+func HandlerRouteAuthTOTPConfirm(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type RequestBody struct {
+			Code string `json:"code"`
+		}
+
+		var requestBody RequestBody
+		err := json.NewDecoder(r.Body).Decode(&requestBody)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		logging.APIEndpoint(r, "POST", "/api/auth/totp/confirm")
+
+		session, _ := SessionFromContext(r.Context())
+		sessionID := session.ID
+		var secret string
+		err = s.DBPool.QueryRow(context.Background(), "SELECT Auth.FN_Pending_TOTP_Secret($1::UUID);", sessionID).Scan(&secret)
+		if err != nil {
+			log.Printf("/api/auth/totp/confirm | %v\n", err)
+			dberr.From(err).WriteJSON(w)
+			return
+		}
+
+		step, ok := totp.Validate(secret, requestBody.Code, time.Now(), 0)
+		if !ok {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "invalid totp code"
+}`)
+			return
+		}
+
+		// Only the hashes of the recovery codes are stored, so this response is the only time they can be seen
+		codes, hashes, err := NewRecoveryCodes()
+		if err == nil {
+			_, err = s.DBPool.Exec(context.Background(), "CALL Auth.SP_Confirm_TOTP_Enrollment($1::UUID, $2::BIGINT, $3::TEXT[]);",
+				sessionID, step, hashes)
+		}
+		if err != nil {
+			log.Printf("/api/auth/totp/confirm | %v\n", err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "Unknown error"
+}`)
+			return
+		}
+
+		RecordAuditEvent(s, r, audit.EventTOTPEnabled, session.Username, sessionID, audit.OutcomeSuccess, "")
+
+		data, _ := json.Marshal(codes)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{
+	"status": "success",
+	"message": "totp enabled, store the recovery codes somewhere safe, they will not be shown again",
+	"data": {
+		"recovery_codes": %s
+	}
+}`, data)
+	}
+}
+
+// HandlerRouteAuthLogInTOTP exchanges the challenge token from HandlerRouteAuthLogIn and a TOTP or recovery code for a session
+func HandlerRouteAuthLogInTOTP(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type RequestBody struct {
+			ChallengeToken string `json:"challenge_token"`
+			Code           string `json:"code"`
+			RecoveryCode   string `json:"recovery_code"`
+			UseCookies     bool   `json:"use_cookies"`
+		}
+
+		var requestBody RequestBody
+		err := json.NewDecoder(r.Body).Decode(&requestBody)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		logging.APIEndpoint(r, "POST", "/api/auth/login/totp")
+
+		if requestBody.ChallengeToken == "" || (requestBody.Code == "") == (requestBody.RecoveryCode == "") {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "request body requires 'challenge_token' and one of 'code' or 'recovery_code'"
+}`)
+			return
+		}
+
+		// The challenge names the user, so that the second factor counts against the same login throttle as the password
+		var username string
+		var secret string
+		var lastUsedStep int64
+		err = s.DBPool.QueryRow(context.Background(), "SELECT username, totp_secret, last_used_step FROM Auth.FN_TOTP_Challenge($1::UUID);",
+			requestBody.ChallengeToken).Scan(&username, &secret, &lastUsedStep)
+		if err != nil {
+			log.Printf("/api/auth/login/totp | %v\n", err)
+			dbErr := dberr.From(err)
+			if dbErr == dberr.ErrNotFound || dbErr == dberr.ErrMalformedID {
+				dbErr = dberr.ErrInvalidChallenge
+			}
+			RecordAuditEvent(s, r, audit.EventLoginFailure, "", "", audit.OutcomeFailure, dbErr.Code)
+			dbErr.WriteJSON(w)
+			return
+		}
+
+		ip := ClientIP(r)
+		attempt := BeginLoginAttempt(s, w, username, ip)
+		if attempt == nil {
+			return
+		}
+		defer attempt.Close()
+
+		var sessionID string
+		var refreshToken string
+		method := "totp"
+		if requestBody.RecoveryCode != "" {
+			method = "recovery code"
+			err = attempt.Run(func(tx pgx.Tx) error {
+				return tx.QueryRow(context.Background(), "SELECT session_id, refresh_token FROM Auth.FN_Complete_TOTP_Challenge_Recovery($1::UUID, $2, $3::INET, $4);",
+					requestBody.ChallengeToken, HashToken(normalizeRecoveryCode(requestBody.RecoveryCode)), ip, r.UserAgent()).Scan(&sessionID, &refreshToken)
+			})
+		} else {
+			step, ok := totp.Validate(secret, requestBody.Code, time.Now(), lastUsedStep)
+			if !ok {
+				// Counts the failure against the challenge, which is thrown away after too many of them, and against
+				// the throttle, so that signing in again for a new challenge doesn't give more guesses
+				_, err = s.DBPool.Exec(context.Background(), "CALL Auth.SP_Fail_TOTP_Challenge($1::UUID);", requestBody.ChallengeToken)
+				if err != nil {
+					log.Printf("/api/auth/login/totp | %v\n", err)
+				}
+				attempt.Fail(r)
+				RecordAuditEvent(s, r, audit.EventLoginFailure, username, "", audit.OutcomeFailure, "invalid totp code")
+
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "invalid totp code"
+}`)
+				return
+			}
+
+			err = attempt.Run(func(tx pgx.Tx) error {
+				return tx.QueryRow(context.Background(), "SELECT session_id, refresh_token FROM Auth.FN_Complete_TOTP_Challenge($1::UUID, $2::BIGINT, $3::INET, $4);",
+					requestBody.ChallengeToken, step, ip, r.UserAgent()).Scan(&sessionID, &refreshToken)
+			})
+		}
+
+		if err != nil {
+			log.Printf("/api/auth/login/totp | %v\n", err)
+			dbErr := dberr.From(err)
+			if dbErr == dberr.ErrInvalidRecoveryCode {
+				attempt.Fail(r)
+			}
+			RecordAuditEvent(s, r, audit.EventLoginFailure, username, "", audit.OutcomeFailure, dbErr.Code)
+			dbErr.WriteJSON(w)
+			return
+		}
+		err = attempt.Succeed()
+		if err != nil {
+			log.Printf("/api/auth/login/totp | %v\n", err)
+			dberr.From(err).WriteJSON(w)
+			return
+		}
+		RecordAuditEvent(s, r, audit.EventLoginSuccess, username, sessionID, audit.OutcomeSuccess, method)
+
+		WriteSignedIn(w, r, http.StatusOK, "signed in", sessionID, refreshToken, requestBody.UseCookies)
+	}
+}
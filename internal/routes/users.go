@@ -0,0 +1,340 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/liamrlawrence/sigil-rest_api/internal/audit"
+	"github.com/liamrlawrence/sigil-rest_api/internal/dberr"
+	"github.com/liamrlawrence/sigil-rest_api/internal/logging"
+	"github.com/liamrlawrence/sigil-rest_api/internal/server"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// accountSetupTTL is how long a user created by an admin has to choose their first password
+	accountSetupTTL = 72 * time.Hour
+
+	usersPageDefault = 50
+	usersPageMax     = 500
+)
+
+// adminBadRequest writes a 400, the message often quotes the request so it is marshalled rather than formatted in
+func adminBadRequest(w http.ResponseWriter, message string) {
+	data, _ := json.Marshal(message)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprintf(w, `{
+	"status": "failed",
+	"message": %s
+}`, data)
+}
+
+// HandlerRouteAdminCreateUser creates a user without a usable password and emails them a token to choose one
+func HandlerRouteAdminCreateUser(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type RequestBody struct {
+			Username string `json:"username"`
+			Email    string `json:"email"`
+			Role     string `json:"role"`
+		}
+
+		var requestBody RequestBody
+		err := json.NewDecoder(r.Body).Decode(&requestBody)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		username := requestBody.Username
+		email := requestBody.Email
+		logging.APIEndpoint(r, "POST", fmt.Sprintf("/api/admin/users - %s", username))
+
+		role := requestBody.Role
+		if role == "" {
+			role = RoleUser
+		}
+		if !OneOf(role, roles) {
+			adminBadRequest(w, fmt.Sprintf("unknown role '%s', expected one of: %s", role, strings.Join(roles, ", ")))
+			return
+		}
+		for _, err := range []error{ValidateUsername(username), ValidateEmail(email)} {
+			if err != nil {
+				adminBadRequest(w, err.Error())
+				return
+			}
+		}
+
+		// Only the hash of the setup token is stored, the token itself is only ever sent in the email
+		token, tokenHash, err := NewOpaqueToken("")
+		if err != nil {
+			log.Printf("/api/admin/users | %v\n", err)
+			dberr.ErrUnknown.WriteJSON(w)
+			return
+		}
+
+		_, err = s.DBPool.Exec(context.Background(), "CALL Auth.SP_Admin_Create_User($1, $2, $3, $4, $5::INTERVAL);",
+			username, email, role, tokenHash, accountSetupTTL)
+		if err != nil {
+			log.Printf("/api/admin/users | %v\n", err)
+			dberr.From(err).WriteJSON(w)
+			return
+		}
+
+		session, _ := SessionFromContext(r.Context())
+		RecordAuditEvent(s, r, audit.EventUserCreated, username, "", audit.OutcomeSuccess, fmt.Sprintf("created with role %s by %s", role, session.Username))
+		SendPasswordResetEmail(s, r, username, email, token, fmt.Sprintf(`An account has been created for you. Use the token below within %d hours to choose your password.`,
+			int(accountSetupTTL.Hours())))
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{
+	"status": "success",
+	"message": "user created, a password setup email has been sent"
+}`)
+	}
+}
+
+// HandlerRouteAdminUsers returns users ordered by username, filtered by the q (matched against username and email),
+// role and disabled query parameters and paginated with limit and offset
+func HandlerRouteAdminUsers(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	type User struct {
+		Username    string     `json:"username"`
+		Email       string     `json:"email"`
+		Role        string     `json:"role"`
+		Disabled    bool       `json:"disabled"`
+		TOTPEnabled bool       `json:"totp_enabled"`
+		CreatedAt   time.Time  `json:"created_at"`
+		LastLoginAt *time.Time `json:"last_login_at"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		logging.APIEndpoint(r, "GET", "/api/admin/users")
+
+		query := r.URL.Query()
+
+		var search, role *string
+		if v := query.Get("q"); v != "" {
+			search = &v
+		}
+		if v := query.Get("role"); v != "" {
+			if !OneOf(v, roles) {
+				adminBadRequest(w, "unknown role")
+				return
+			}
+			role = &v
+		}
+		var disabled *bool
+		if v := query.Get("disabled"); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				adminBadRequest(w, "'disabled' must be true or false")
+				return
+			}
+			disabled = &b
+		}
+
+		limit, offset, err := PageParams(query, usersPageDefault, usersPageMax)
+		if err != nil {
+			adminBadRequest(w, err.Error())
+			return
+		}
+
+		// Ask for one extra row to find out whether there is another page
+		rows, err := s.DBPool.Query(context.Background(), `SELECT username, email, role, disabled, totp_enabled, created_at, last_login_at
+FROM Auth.FN_Admin_List_Users($1, $2, $3::BOOLEAN, $4::INT, $5::INT);`,
+			search, role, disabled, limit+1, offset)
+		if err != nil {
+			log.Printf("/api/admin/users | %v\n", err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "failed to get users"
+}`)
+			return
+		}
+		defer rows.Close()
+
+		users := []User{}
+		for rows.Next() {
+			var u User
+			err = rows.Scan(&u.Username, &u.Email, &u.Role, &u.Disabled, &u.TOTPEnabled, &u.CreatedAt, &u.LastLoginAt)
+			if err != nil {
+				break
+			}
+			users = append(users, u)
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		if err != nil {
+			log.Printf("/api/admin/users | %v\n", err)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{
+	"status": "failed",
+	"message": "failed to get users during query"
+}`)
+			return
+		}
+
+		nextOffset := "null"
+		if len(users) > limit {
+			users = users[:limit]
+			nextOffset = strconv.Itoa(offset + limit)
+		}
+
+		data, _ := json.Marshal(users)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{
+	"status": "success",
+	"message": "got users",
+	"data": %s,
+	"pagination": {
+		"limit": %d,
+		"offset": %d,
+		"next_offset": %s
+	}
+}`, data, limit, offset, nextOffset)
+	}
+}
+
+// HandlerRouteAdminSetUserDisabled disables or re-enables a user. Disabling revokes every session of the user,
+// and their API keys stop working until the account is enabled again.
+func HandlerRouteAdminSetUserDisabled(s *server.Server, disabled bool) func(w http.ResponseWriter, r *http.Request) {
+	action, eventType, message := "enable", audit.EventUserEnabled, "account enabled"
+	if disabled {
+		action, eventType, message = "disable", audit.EventUserDisabled, "account disabled, every session was revoked"
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "username")
+		logging.APIEndpoint(r, "POST", fmt.Sprintf("/api/admin/users/%s/%s", username, action))
+
+		session, _ := SessionFromContext(r.Context())
+		if disabled && username == session.Username {
+			adminBadRequest(w, "you can't disable your own account")
+			return
+		}
+
+		_, err := s.DBPool.Exec(context.Background(), "CALL Auth.SP_Admin_Set_User_Disabled($1, $2);", username, disabled)
+		if err != nil {
+			log.Printf("/api/admin/users/%s | %v\n", action, err)
+			dberr.From(err).WriteJSON(w)
+			return
+		}
+		if disabled {
+			s.SessionCache.NotifyUser(context.Background(), s.DBPool, username)
+		}
+		RecordAuditEvent(s, r, eventType, username, "", audit.OutcomeSuccess, fmt.Sprintf("%sd by %s", action, session.Username))
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{
+	"status": "success",
+	"message": "%s"
+}`, message)
+	}
+}
+
+// HandlerRouteAdminForcePasswordReset revokes every session of the user, clears their password and emails them a reset token
+func HandlerRouteAdminForcePasswordReset(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "username")
+		logging.APIEndpoint(r, "POST", fmt.Sprintf("/api/admin/users/%s/password-reset", username))
+
+		token, tokenHash, err := NewOpaqueToken("")
+		if err != nil {
+			log.Printf("/api/admin/users/password-reset | %v\n", err)
+			dberr.ErrUnknown.WriteJSON(w)
+			return
+		}
+
+		var email string
+		err = s.DBPool.QueryRow(context.Background(), "SELECT Auth.FN_Admin_Force_Password_Reset($1, $2, $3::INTERVAL);",
+			username, tokenHash, passwordResetTTL).Scan(&email)
+		if err != nil {
+			log.Printf("/api/admin/users/password-reset | %v\n", err)
+			dbErr := dberr.From(err)
+			if dbErr == dberr.ErrNotFound {
+				dbErr = dberr.ErrUserNotFound
+			}
+			dbErr.WriteJSON(w)
+			return
+		}
+		s.SessionCache.NotifyUser(context.Background(), s.DBPool, username)
+
+		session, _ := SessionFromContext(r.Context())
+		RecordAuditEvent(s, r, audit.EventPasswordReset, username, "", audit.OutcomeSuccess, fmt.Sprintf("forced by %s, revoked every session", session.Username))
+		SendPasswordResetEmail(s, r, username, email, token, fmt.Sprintf(`An administrator has reset the password for your account. Use the token below within %d minutes to choose a new password.`,
+			int(passwordResetTTL.Minutes())))
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{
+	"status": "success",
+	"message": "password reset, every session was revoked and a password reset email has been sent"
+}`)
+	}
+}
+
+func HandlerRouteAdminSetUserRole(s *server.Server) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type RequestBody struct {
+			Role string `json:"role"`
+		}
+
+		var requestBody RequestBody
+		err := json.NewDecoder(r.Body).Decode(&requestBody)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		username := chi.URLParam(r, "username")
+		role := requestBody.Role
+		logging.APIEndpoint(r, "PUT", fmt.Sprintf("/api/admin/users/%s/role - %s", username, role))
+
+		if !OneOf(role, roles) {
+			adminBadRequest(w, fmt.Sprintf("unknown role '%s', expected one of: %s", role, strings.Join(roles, ", ")))
+			return
+		}
+
+		session, _ := SessionFromContext(r.Context())
+		if username == session.Username && role != RoleAdmin {
+			adminBadRequest(w, "you can't remove your own admin role")
+			return
+		}
+
+		var previousRole string
+		err = s.DBPool.QueryRow(context.Background(), "SELECT Auth.FN_Admin_Set_User_Role($1, $2);", username, role).Scan(&previousRole)
+		if err != nil {
+			log.Printf("/api/admin/users/role | %v\n", err)
+			dbErr := dberr.From(err)
+			if dbErr == dberr.ErrNotFound {
+				dbErr = dberr.ErrUserNotFound
+			}
+			dbErr.WriteJSON(w)
+			return
+		}
+
+		// Cached sessions carry the role, so they have to be dropped for the change to apply straight away
+		s.SessionCache.NotifyUser(context.Background(), s.DBPool, username)
+		RecordAuditEvent(s, r, audit.EventRoleChanged, username, "", audit.OutcomeSuccess,
+			fmt.Sprintf("changed from %s to %s by %s", previousRole, role, session.Username))
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{
+	"status": "success",
+	"message": "role changed"
+}`)
+	}
+}
@@ -0,0 +1,91 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strconv"
+	"unicode"
+)
+
+const (
+	minPasswordLength = 12
+	maxPasswordLength = 128
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_.-]{2,31}$`)
+
+func ValidateUsername(username string) error {
+	if !usernamePattern.MatchString(username) {
+		return errors.New("username must be 3-32 characters, start with a letter, and only contain letters, digits, '_', '.' or '-'")
+	}
+	return nil
+}
+
+func ValidateEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return errors.New("email address is invalid")
+	}
+	return nil
+}
+
+// ValidatePassword checks a new password and its confirmation against the password policy
+func ValidatePassword(password string, passwordConfirm string) error {
+	if password != passwordConfirm {
+		return errors.New("passwords do not match")
+	}
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return errors.New("password must be 12-128 characters long")
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			hasUpper = true
+		case unicode.IsLower(c):
+			hasLower = true
+		case unicode.IsDigit(c):
+			hasDigit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c) || unicode.IsSpace(c):
+			hasSymbol = true
+		}
+	}
+	if !hasUpper || !hasLower || !hasDigit || !hasSymbol {
+		return errors.New("password must contain an uppercase letter, a lowercase letter, a digit and a symbol")
+	}
+	return nil
+}
+
+// OneOf reports whether value is one of the allowed values
+func OneOf[T comparable](value T, allowed []T) bool {
+	for _, candidate := range allowed {
+		if value == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+// PageParams reads the limit and offset query parameters of a paginated list, limit defaulting to defaultLimit
+func PageParams(query url.Values, defaultLimit int, maxLimit int) (limit int, offset int, err error) {
+	limit = defaultLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxLimit {
+			return 0, 0, fmt.Errorf("'limit' must be between 1 and %d", maxLimit)
+		}
+		limit = n
+	}
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, errors.New("'offset' must be a positive number")
+		}
+		offset = n
+	}
+	return limit, offset, nil
+}
@@ -3,9 +3,20 @@ package server
 import (
 	"github.com/go-chi/chi/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/liamrlawrence/sigil-rest_api/internal/llm"
+	"github.com/liamrlawrence/sigil-rest_api/internal/mailer"
+	"github.com/liamrlawrence/sigil-rest_api/internal/models"
+	"github.com/liamrlawrence/sigil-rest_api/internal/oidc"
+	"github.com/liamrlawrence/sigil-rest_api/internal/sessioncache"
 )
 
 type Server struct {
 	DBPool *pgxpool.Pool
 	Router *chi.Mux
+	Mailer mailer.Mailer
+	OIDC   *oidc.Provider
+
+	SessionCache *sessioncache.Cache
+	Models       *models.Registry
+	Providers    llm.Providers
 }
@@ -0,0 +1,258 @@
+package sessioncache
+
+import (
+	"container/list"
+	"context"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Channel is the Postgres NOTIFY channel used to tell every replica to drop cached sessions
+const Channel = "auth_session_invalidated"
+
+type Entry struct {
+	Username       string
+	Role           string
+	ImpersonatedBy string
+}
+
+type Stats struct {
+	Size          int    `json:"size"`
+	Capacity      int    `json:"capacity"`
+	TTLSeconds    int    `json:"ttl_seconds"`
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Evictions     uint64 `json:"evictions"`
+	Invalidations uint64 `json:"invalidations"`
+}
+
+type item struct {
+	sessionID string
+	entry     Entry
+	expiresAt time.Time
+}
+
+// Cache is a bounded LRU of validated sessions, each kept for at most ttl
+type Cache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List
+	items    map[string]*list.Element
+
+	// generation goes up on every invalidation, cached or not, so that a session read from the database
+	// before a revocation isn't cached after it
+	generation uint64
+
+	hits          atomic.Uint64
+	misses        atomic.Uint64
+	evictions     atomic.Uint64
+	invalidations atomic.Uint64
+}
+
+func New(capacity int, ttl time.Duration) *Cache {
+	return &Cache{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// NewFromEnv sizes the cache from AUTH_SESSION_CACHE_SIZE and AUTH_SESSION_CACHE_TTL, defaulting to 10000 sessions for 30s
+func NewFromEnv() *Cache {
+	capacity, err := strconv.Atoi(os.Getenv("AUTH_SESSION_CACHE_SIZE"))
+	if err != nil || capacity <= 0 {
+		capacity = 10000
+	}
+	ttl, err := time.ParseDuration(os.Getenv("AUTH_SESSION_CACHE_TTL"))
+	if err != nil || ttl <= 0 {
+		ttl = 30 * time.Second
+	}
+	return New(capacity, ttl)
+}
+
+// Generation is taken before validating a session in the database, and passed to Set with the result
+func (c *Cache) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+func (c *Cache) Get(sessionID string) (Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[sessionID]
+	if !ok {
+		c.misses.Add(1)
+		return Entry{}, false
+	}
+
+	it := el.Value.(*item)
+	if time.Now().After(it.expiresAt) {
+		c.remove(el)
+		c.misses.Add(1)
+		return Entry{}, false
+	}
+
+	c.order.MoveToFront(el)
+	c.hits.Add(1)
+	return it.entry, true
+}
+
+// Set caches a validated session until the TTL passes or the session expires, whichever is first.
+// Nothing is cached when anything was invalidated since generation was taken, since the session may have been.
+func (c *Cache) Set(sessionID string, entry Entry, sessionExpiresAt time.Time, generation uint64) {
+	expiresAt := time.Now().Add(c.ttl)
+	if !sessionExpiresAt.IsZero() && sessionExpiresAt.Before(expiresAt) {
+		expiresAt = sessionExpiresAt
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.generation != generation {
+		return
+	}
+
+	if el, ok := c.items[sessionID]; ok {
+		it := el.Value.(*item)
+		it.entry = entry
+		it.expiresAt = expiresAt
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.items[sessionID] = c.order.PushFront(&item{sessionID: sessionID, entry: entry, expiresAt: expiresAt})
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+		c.evictions.Add(1)
+	}
+}
+
+func (c *Cache) Invalidate(sessionID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+
+	if el, ok := c.items[sessionID]; ok {
+		c.remove(el)
+		c.invalidations.Add(1)
+	}
+}
+
+func (c *Cache) InvalidateUser(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+
+	for el := c.order.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*item).entry.Username == username {
+			c.remove(el)
+			c.invalidations.Add(1)
+		}
+		el = next
+	}
+}
+
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	size := c.order.Len()
+	c.mu.Unlock()
+
+	return Stats{
+		Size:          size,
+		Capacity:      c.capacity,
+		TTLSeconds:    int(c.ttl.Seconds()),
+		Hits:          c.hits.Load(),
+		Misses:        c.misses.Load(),
+		Evictions:     c.evictions.Load(),
+		Invalidations: c.invalidations.Load(),
+	}
+}
+
+func (c *Cache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*item).sessionID)
+}
+
+// Notify drops the session locally and asks every replica listening on Channel to drop it too
+func (c *Cache) Notify(ctx context.Context, pool *pgxpool.Pool, sessionID string) {
+	c.Invalidate(sessionID)
+	notify(ctx, pool, "session:"+sessionID)
+}
+
+// NotifyUser drops every session of the user locally and on every replica listening on Channel
+func (c *Cache) NotifyUser(ctx context.Context, pool *pgxpool.Pool, username string) {
+	c.InvalidateUser(username)
+	notify(ctx, pool, "user:"+username)
+}
+
+func notify(ctx context.Context, pool *pgxpool.Pool, payload string) {
+	_, err := pool.Exec(ctx, "SELECT pg_notify($1, $2);", Channel, payload)
+	if err != nil {
+		log.Printf("session cache: notify %s: %v", payload, err)
+	}
+}
+
+// Listen applies invalidations sent by other replicas until ctx is cancelled, reconnecting when the connection drops
+func (c *Cache) Listen(ctx context.Context, pool *pgxpool.Pool) {
+	for ctx.Err() == nil {
+		err := c.listen(ctx, pool)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("session cache: listen: %v", err)
+
+		// Anything could have been revoked while we weren't listening
+		c.mu.Lock()
+		c.generation++
+		c.order.Init()
+		c.items = make(map[string]*list.Element)
+		c.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (c *Cache) listen(ctx context.Context, pool *pgxpool.Pool) error {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "LISTEN "+Channel+";")
+	if err != nil {
+		return err
+	}
+
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		kind, value, _ := strings.Cut(notification.Payload, ":")
+		switch kind {
+		case "session":
+			c.Invalidate(value)
+		case "user":
+			c.InvalidateUser(value)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package sessioncache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetAfterInvalidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		invalidate func(c *Cache)
+	}{
+		{"session", func(c *Cache) { c.Invalidate("session-1") }},
+		{"user", func(c *Cache) { c.InvalidateUser("alice") }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(10, time.Minute)
+
+			// The session is revoked while it is being validated, before it was ever cached
+			generation := c.Generation()
+			tt.invalidate(c)
+			c.Set("session-1", Entry{Username: "alice"}, time.Time{}, generation)
+
+			if _, ok := c.Get("session-1"); ok {
+				t.Error("a session validated before it was invalidated was cached")
+			}
+
+			c.Set("session-1", Entry{Username: "alice"}, time.Time{}, c.Generation())
+			if _, ok := c.Get("session-1"); !ok {
+				t.Error("a session validated after the invalidation wasn't cached")
+			}
+		})
+	}
+}